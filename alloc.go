@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Pages can be allocated and freed explicitly. ALLOC_PAGE asks the Central Manager of a shard for
+// a page with a new ID; it records the requester as the owner and sends it the empty page, like
+// the first write to an unknown page does. FREE_PAGE has the Central Manager invalidate every
+// copy of a page, tell the owner to drop it and forget everything about it but its ID, so that
+// later requests for the page fail with ErrPageFreed and the ID is never handed out again.
+// In DYNAMIC mode the Central Manager doesn't know where a page is, so pages can't be freed.
+
+// Alloc allocates a new page with a coherence policy, the cluster's CoherencePolicy if empty,
+// and returns its ID. The Client owns the page once Alloc returns. Shards take turns.
+// A retry carries the same sequence number, so a lost reply doesn't allocate a second page.
+func (c *Client) Alloc(ctx context.Context, policy string) (string, error) {
+	seq := c.nextSeq()
+	shard := int(seq % uint64(Managers))
+	alloc := Message{
+		Type: ALLOC_PAGE,
+		Payload: Payload{
+			Alloc: Alloc{
+				Policy: policy,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+		Seq:      seq,
+	}
+	reply, err := c.request(ctx, "alloc", fmt.Sprintf("in shard %d", shard), shard, alloc)
+	if err != nil {
+		return "", err
+	}
+	return reply.Page.PageId, nil
+}
+
+// Free frees a page. Every copy of it is dropped, and reads and writes of it fail with ErrPageFreed.
+func (c *Client) Free(ctx context.Context, pageNo string) error {
+	free := Message{
+		Type: FREE_PAGE,
+		Payload: Payload{
+			Alloc: Alloc{
+				PgNo: pageNo,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+		Seq:      c.nextSeq(),
+	}
+	if _, err := c.request(ctx, "free", pageNo, shardOf(pageNo), free); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.deleteLocked(pageNo)
+	c.mu.Unlock()
+	return nil
+}
+
+// dropFreed drops a page that has been freed. An owner that keeps the page's copies invalidates them.
+func (c *Client) dropFreed(pageNo string) {
+	c.lockUnpinned(pageNo)
+	page, exists := c.PgCopySet[pageNo]
+	c.deleteLocked(pageNo)
+	c.mu.Unlock()
+	if !exists {
+		return
+	}
+	if page.Owned {
+		c.invalidateHolders(pageNo, page.CopySet, ClientPointer{ID: -1})
+	}
+	syscolor.Printf("Dropped freed Page %s\n", pageNo)
+}
+
+// newPageID stores the information of a new page under an ID that has never been used in the
+// shard and returns the ID. Freed pages keep their IDs, so a backup that took over skips them too.
+func (cm *CentralManager) newPageID(info PgInfo) string {
+	defer cm.syncLog()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for {
+		cm.allocs++
+		pgNo := fmt.Sprintf("page%d", cm.allocs)
+		if _, used := cm.MetaData[pgNo]; !used && shardOf(pgNo) == cm.Shard {
+			cm.MetaData[pgNo] = info
+			cm.logLocked(pgNo, info, false)
+			return pgNo
+		}
+	}
+}
+
+// handleAlloc creates a page with a new ID owned by the Client that asked for it.
+// It returns the ID and the reason if it failed.
+func (cm *CentralManager) handleAlloc(msg Message) (string, string) {
+	policy := msg.Payload.Alloc.Policy
+	if policy == "" {
+		policy = CoherencePolicy
+	}
+	requester := ClientPointer{ID: msg.SenderID, IP: msg.SenderIP}
+	pgNo := cm.newPageID(PgInfo{
+		Owner:   requester,
+		CopySet: []ClientPointer{},
+		Policy:  policy,
+	})
+	t := cm.queue.enter(pgNo, requester.ID)
+	defer cm.queue.leave(pgNo, t)
+
+	pageSend := Message{
+		Type: PAGE_SEND,
+		Payload: Payload{
+			PgSend: PgSend{
+				Purpose: WRITE,
+				Page:    newPage(pgNo, policy),
+			},
+		},
+	}
+	sendcolor.Printf("Central Manager sending new Page %s to Client %d\n", pgNo, requester.ID)
+	if reply := cm.CallRPC(pageSend, CLIENT, requester.ID, requester.IP); !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", requester.ID, removeUnderscores(PAGE_SEND))
+		cm.deletePageInfo(pgNo)
+		return "", NOT_CONFIRMED
+	}
+	if cm.mode != DYNAMIC {
+		// The requester is recorded as the owner already, a late confirmation only holds back the next request
+		cm.awaitConfirmation(pgNo, t)
+	}
+	syscolor.Printf("Allocated Page %s to Client %d\n", pgNo, requester.ID)
+	return pgNo, ""
+}
+
+// handleFree invalidates every copy of a page, has its owner drop it and forgets the page.
+// It returns the reason if it failed.
+func (cm *CentralManager) handleFree(msg Message) string {
+	pgNo := msg.Payload.Alloc.PgNo
+	if shardOf(pgNo) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", pgNo, cm.Shard)
+		return WRONG_MANAGER
+	}
+	if cm.mode == DYNAMIC {
+		errcolor.Printf("Pages can't be freed in %s mode\n", DYNAMIC)
+		return FREE_UNSUPPORTED
+	}
+	t := cm.queue.enter(pgNo, msg.SenderID)
+	defer cm.queue.leave(pgNo, t)
+
+	info, exists := cm.pageInfo(pgNo)
+	if !exists {
+		errcolor.Printf("Central Manager doesn't have Page %s\n", pgNo)
+		return PAGE_NOT_FOUND
+	}
+	if info.Freed {
+		return PAGE_FREED
+	}
+	if info.Home != nil {
+		if !cm.invalidateHome(pgNo, info, -1) {
+			return INVALIDATION_FAILED
+		}
+	} else {
+		// In IMPROVED mode the owner invalidates the copies itself when it drops the page
+		if cm.mode != IMPROVED && !cm.invalidateCopies(pgNo, info.CopySet, -1) {
+			return INVALIDATION_FAILED
+		}
+		drop := Message{
+			Type: INVALIDATE_COPY,
+			Payload: Payload{
+				InvCopy: InvCopy{
+					WriteReqID: -1,
+					PgNum:      pgNo,
+					Freed:      true,
+				},
+			},
+		}
+		sendcolor.Printf("Central Manager telling Client %d to drop Page %s\n", info.Owner.ID, pgNo)
+		if reply := cm.CallRPC(drop, CLIENT, info.Owner.ID, info.Owner.IP); !reply.Ack {
+			// Nothing is forwarded to the owner any more, so its copy is never read again
+			warningcolor.Printf("Owner Client %d of Page %s could not be told to drop it\n", info.Owner.ID, pgNo)
+		}
+	}
+	cm.setPageInfo(pgNo, PgInfo{Version: info.Version, Policy: info.Policy, Freed: true})
+	syscolor.Printf("Client %d freed Page %s\n", msg.SenderID, pgNo)
+	return ""
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestAllocatedPagesHaveNewIDs(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	var mu sync.Mutex
+	owners := map[string]int{}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				pageNo, err := c.Alloc(ctx, "")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if _, taken := owners[pageNo]; taken {
+					t.Errorf("%s allocated twice", pageNo)
+				}
+				owners[pageNo] = c.ID
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for pageNo, owner := range owners {
+		if info, _ := cm.pageInfo(pageNo); info.Owner.ID != owner {
+			t.Fatalf("%s owned by %d, want %d", pageNo, info.Owner.ID, owner)
+		}
+	}
+}
+
+func TestFreedPageCantBeUsed(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	pageNo, err := clients[0].Alloc(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[0].Write(ctx, pageNo, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients[1].Read(ctx, pageNo); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[1].Free(ctx, pageNo); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if _, held := c.page(pageNo); held {
+			t.Fatalf("Client %d still holds the freed page", c.ID)
+		}
+		if _, err := c.Read(ctx, pageNo); !errors.Is(err, ErrPageFreed) {
+			t.Fatalf("read got %v, want ErrPageFreed", err)
+		}
+		if err := c.Write(ctx, pageNo, []byte("y")); !errors.Is(err, ErrPageFreed) {
+			t.Fatalf("write got %v, want ErrPageFreed", err)
+		}
+	}
+	if err := clients[0].Free(ctx, pageNo); !errors.Is(err, ErrPageFreed) {
+		t.Fatalf("second free got %v, want ErrPageFreed", err)
+	}
+	if info, _ := cm.pageInfo(pageNo); !info.Freed {
+		t.Fatal("ID of the freed page forgotten")
+	}
+}
+
+func TestFreeOfAnEvictedPage(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	c := clients[0]
+	c.SetCapacity(1)
+	evicted, err := c.Alloc(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Alloc(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	settled(t, cm, evicted, func(info PgInfo) bool { return info.Home != nil })
+	if err := clients[1].Free(ctx, evicted); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := cm.pageInfo(evicted); !info.Freed || info.Home != nil {
+		t.Fatalf("page info %+v, want the home copy freed", info)
+	}
+}
+
+func TestRepeatedAllocAndFreeRunOnce(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 1)
+	c := clients[0]
+	alloc := Message{Type: ALLOC_PAGE, SenderID: c.ID, SenderIP: c.IP, Seq: 42}
+	var first, again Reply
+	cm.HandleIncMsg(alloc, &first)
+	cm.HandleIncMsg(alloc, &again)
+	if first.Err != "" || first.Page.PageId == "" {
+		t.Fatalf("alloc got %+v", first)
+	}
+	if !again.Duplicate || again.Page.PageId != first.Page.PageId || len(cm.metaDataCopy()) != 1 {
+		t.Fatalf("repeated alloc got %+v, want the same page", again)
+	}
+	free := Message{Type: FREE_PAGE, SenderID: c.ID, SenderIP: c.IP, Seq: 43, Payload: Payload{Alloc: Alloc{PgNo: first.Page.PageId}}}
+	first, again = Reply{}, Reply{}
+	cm.HandleIncMsg(free, &first)
+	cm.HandleIncMsg(free, &again)
+	if first.Err != "" || again.Err != "" || !again.Duplicate {
+		t.Fatalf("free got %+v and %+v, want the repeat answered like the first", first, again)
+	}
+}
+
+func TestReadConfirmationIgnoredForFreedPage(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.setPageInfo("P1", PgInfo{Freed: true})
+	turn := cm.queue.enter("P1", 2)
+	var reply Reply
+	cm.HandleIncMsg(readConfirmation("P1", 2), &reply)
+	if reply.Ack {
+		t.Fatal("confirmation for a freed page acknowledged")
+	}
+	cm.queue.leave("P1", turn)
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 0 {
+		t.Fatalf("CopySet %v, want the freed page left alone", info.CopySet)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// WORD_SIZE is the size of the words CompareAndSwap and FetchAndAdd work on
+const WORD_SIZE = 8
+
+// ErrWordRange is returned for a word that doesn't fit in a page
+var ErrWordRange = errors.New("word doesn't fit in the page")
+
+// The atomics work on little-endian 8 byte words at an offset in a page. They are made with
+// the write itself: the word is changed while the Client holds the page with READWRITE access
+// and before the write is confirmed, so the page can't be handed to another writer between reading
+// the word and changing it. They are never buffered or sent as diffs, so they fail on MULTIPLE pages.
+
+// CompareAndSwap sets the word at offset in a page to replacement if it is old, and reports whether it did
+func (c *Client) CompareAndSwap(ctx context.Context, pageNo string, offset int, old int64, replacement int64) (bool, error) {
+	swapped := false
+	err := c.atomic(ctx, pageNo, offset, func(word int64) int64 {
+		swapped = word == old
+		if swapped {
+			return replacement
+		}
+		return word
+	})
+	return swapped, err
+}
+
+// FetchAndAdd adds delta to the word at offset in a page and returns the word before the addition
+func (c *Client) FetchAndAdd(ctx context.Context, pageNo string, offset int, delta int64) (int64, error) {
+	var fetched int64
+	err := c.atomic(ctx, pageNo, offset, func(word int64) int64 {
+		fetched = word
+		return word + delta
+	})
+	return fetched, err
+}
+
+// atomic replaces the word at offset in a page with fn applied to it. Writes to the page
+// buffered under a lock come before it, so they are written back first; writes to other pages
+// stay buffered until the lock is released.
+func (c *Client) atomic(ctx context.Context, pageNo string, offset int, fn func(word int64) int64) error {
+	if offset < 0 || offset > PageSize-WORD_SIZE {
+		return &PageError{Op: "write", PgNo: pageNo, Err: ErrWordRange}
+	}
+	if page, exists := c.page(pageNo); exists && page.Dirty && page.Policy != MULTIPLE {
+		if err := c.writeBack(ctx, page); err != nil {
+			return err
+		}
+	}
+	return c.writeThrough(ctx, pageNo, "", func(content []byte) {
+		word := int64(binary.LittleEndian.Uint64(content[offset:]))
+		binary.LittleEndian.PutUint64(content[offset:], uint64(fn(word)))
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestAtomicsAreNotLost(t *testing.T) {
+	for _, mode := range []string{CENTRALIZED, IMPROVED, DYNAMIC} {
+		t.Run(mode, func(t *testing.T) {
+			_, clients := startCluster(t, mode, 3)
+			ctx := context.Background()
+			var mu sync.Mutex
+			fetched := map[int64]bool{}
+			var wg sync.WaitGroup
+			for _, c := range clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 15 {
+						word, err := c.FetchAndAdd(ctx, "CTR", 8, 1)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						if fetched[word] {
+							t.Errorf("%d fetched twice", word)
+						}
+						fetched[word] = true
+						mu.Unlock()
+						// Increment the word at 16 with compare-and-swap until nobody got in between
+						for swapped := false; !swapped; {
+							word, _ := c.FetchAndAdd(ctx, "CTR", 16, 0)
+							if swapped, err = c.CompareAndSwap(ctx, "CTR", 16, word, word+1); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			content, err := clients[0].Read(ctx, "CTR")
+			if err != nil {
+				t.Fatal(err)
+			}
+			added, swapped := binary.LittleEndian.Uint64(content[8:]), binary.LittleEndian.Uint64(content[16:])
+			if added != 45 || swapped != 45 {
+				t.Fatalf("words are %d and %d, want 45", added, swapped)
+			}
+		})
+	}
+}
+
+func TestAtomicWordMustFitInThePage(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 1)
+	ctx := context.Background()
+	for _, offset := range []int{-1, PageSize - 4} {
+		if _, err := clients[0].FetchAndAdd(ctx, "CTR", offset, 1); !errors.Is(err, ErrWordRange) {
+			t.Fatalf("offset %d got %v, want ErrWordRange", offset, err)
+		}
+	}
+}
+
+func TestAtomicInASectionWritesBackOnlyItsPage(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	c, reader := clients[0], clients[1]
+	for _, pageNo := range []string{"A", "B"} {
+		if err := c.Write(ctx, pageNo, []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Acquire(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pageNo := range []string{"A", "B"} {
+		if err := c.Write(ctx, pageNo, []byte("buffered")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.FetchAndAdd(ctx, "B", 16, 1); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := c.page("A"); !page.Dirty {
+		t.Fatal("A was written back by an atomic on B")
+	}
+	// The buffered write to B comes before the atomic
+	content, err := reader.Read(ctx, "B")
+	if err != nil || text(content[:16]) != "buffered" || content[16] != 1 {
+		t.Fatalf("read %q, %v, want the buffered write and the addition", content[:17], err)
+	}
+	if err := c.Release(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := reader.Read(ctx, "A"); err != nil || text(content) != "buffered" {
+		t.Fatalf("read %q, %v, want \"buffered\"", text(content), err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// BARRIER_TIMEOUT is how long the run command waits for the other Clients to enter it
+const BARRIER_TIMEOUT = 5 * time.Minute
+
+// BarrierState is the round of a barrier being collected and the Clients that have arrived at it
+type BarrierState struct {
+	N       int
+	Round   int
+	Arrived map[int]ClientPointer // keyed by Client ID, so an arrival sent again is only counted once
+}
+
+// barrierWait is a Client's Barrier call waiting for the BARRIER_RELEASE of its round
+type barrierWait struct {
+	round    int
+	released chan struct{}
+}
+
+// Every Client numbers its passes through a barrier, so the Central Manager can tell an arrival
+// sent again from one at the next round. An arrival at a round the Central Manager hasn't reached
+// means that round was released by a Central Manager that failed before replicating it.
+
+// handleBarrierArrive records an arrival and releases the round once n Clients have arrived.
+// It returns BARRIER_WAITING if the sender has to wait for a BARRIER_RELEASE.
+func (cm *CentralManager) handleBarrierArrive(msg Message) string {
+	arrive := msg.Payload.Barrier
+	cm.mu.Lock()
+	barrier, exists := cm.Barriers[arrive.Name]
+	if !exists {
+		barrier = BarrierState{N: arrive.N, Round: 1}
+	}
+	if arrive.Round < barrier.Round {
+		cm.mu.Unlock()
+		return ""
+	}
+	if arrive.Round > barrier.Round {
+		warningcolor.Printf("Barrier %s skipped to round %d, round %d was already released\n", arrive.Name, arrive.Round, barrier.Round)
+		barrier = BarrierState{N: arrive.N, Round: arrive.Round}
+	}
+	if len(barrier.Arrived) > 0 && arrive.N != barrier.N {
+		cm.mu.Unlock()
+		errcolor.Printf("Client %d expects %d Clients at barrier %s but the others expect %d\n", msg.SenderID, arrive.N, arrive.Name, barrier.N)
+		return BARRIER_MISMATCH
+	}
+	barrier.N = arrive.N
+	arrived := make(map[int]ClientPointer, len(barrier.Arrived)+1)
+	for id, client := range barrier.Arrived {
+		arrived[id] = client
+	}
+	arrived[msg.SenderID] = ClientPointer{ID: msg.SenderID, IP: msg.SenderIP}
+	barrier.Arrived = arrived
+	syscolor.Printf("Client %d arrived at barrier %s round %d (%d of %d)\n", msg.SenderID, arrive.Name, barrier.Round, len(arrived), barrier.N)
+	if len(arrived) < barrier.N {
+		cm.Barriers[arrive.Name] = barrier
+		cm.mu.Unlock()
+		return BARRIER_WAITING
+	}
+	cm.Barriers[arrive.Name] = BarrierState{N: barrier.N, Round: barrier.Round + 1}
+	cm.mu.Unlock()
+
+	syscolor.Printf("Barrier %s round %d released\n", arrive.Name, barrier.Round)
+	release := Message{
+		Type: BARRIER_RELEASE,
+		Payload: Payload{
+			Barrier: Barrier{
+				Name:  arrive.Name,
+				Round: barrier.Round,
+			},
+		},
+	}
+	for id, client := range arrived {
+		if id == msg.SenderID {
+			continue
+		}
+		// A Client that misses the release finds out when it sends its arrival again
+		go cm.CallRPC(release, CLIENT, client.ID, client.IP)
+	}
+	return ""
+}
+
+// setBarriers replaces the barrier table, e.g. with a copy received from another Central Manager
+func (cm *CentralManager) setBarriers(barriers map[string]BarrierState) {
+	if barriers == nil {
+		barriers = map[string]BarrierState{}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.Barriers = barriers
+}
+
+// barriersCopy returns a copy of the barrier table that is safe to send
+func (cm *CentralManager) barriersCopy() map[string]BarrierState {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	barriers := make(map[string]BarrierState, len(cm.Barriers))
+	for name, barrier := range cm.Barriers {
+		arrived := make(map[int]ClientPointer, len(barrier.Arrived))
+		for id, client := range barrier.Arrived {
+			arrived[id] = client
+		}
+		barrier.Arrived = arrived
+		barriers[name] = barrier
+	}
+	return barriers
+}
+
+// Barrier blocks until n Clients have called Barrier with the same name, or ctx is done.
+// The arrival is sent again every attempt timeout, and straight away when the Central Manager
+// changes, so that a barrier survives a failover. Buffered writes are written back before arriving,
+// so the other Clients see them once they pass the barrier.
+func (c *Client) Barrier(ctx context.Context, name string, n int) error {
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+	wait := &barrierWait{released: make(chan struct{}, 1)}
+	c.mu.Lock()
+	c.barrierRounds[name]++
+	wait.round = c.barrierRounds[name]
+	c.barrierWaits[name] = wait
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.barrierWaits, name)
+		c.mu.Unlock()
+	}()
+
+	for {
+		cmChanged := c.cmChanged()
+		reply := c.sendBarrierArrive(name, n, wait.round)
+		if reply.Ack && reply.Err == "" {
+			return nil
+		}
+		if reply.Ack && reply.Err != BARRIER_WAITING {
+			c.leaveBarrier(name)
+			return &PageError{Op: "barrier", PgNo: name, Err: replyError(reply)}
+		}
+		timer := time.NewTimer(c.retryPolicy().AttemptTimeout)
+		select {
+		case <-wait.released:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		case <-cmChanged:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			c.leaveBarrier(name)
+			return &PageError{Op: "barrier", PgNo: name, Err: ErrTimeout}
+		}
+	}
+}
+
+// leaveBarrier takes back the round of a Barrier call that failed, so the next call arrives at
+// the same round again. If that round was released in the meantime the next call returns at once.
+func (c *Client) leaveBarrier(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.barrierRounds[name]--
+}
+
+// sends a BARRIER_ARRIVE message
+func (c *Client) sendBarrierArrive(name string, n int, round int) Reply {
+	arrive := Message{
+		Type: BARRIER_ARRIVE,
+		Payload: Payload{
+			Barrier: Barrier{
+				Name:  name,
+				N:     n,
+				Round: round,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	reply := c.CallRPC(arrive, CENTRALMANAGER, -1, c.cmIP(name))
+	if !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(BARRIER_ARRIVE))
+	}
+	return reply
+}
+
+// handleBarrierRelease wakes up the Barrier call waiting for the released round
+func (c *Client) handleBarrierRelease(msg Message) {
+	release := msg.Payload.Barrier
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wait, waiting := c.barrierWaits[release.Name]
+	if !waiting || wait.round != release.Round {
+		return
+	}
+	select {
+	case wait.released <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBarrierHoldsEveryRoundUntilAllArrive(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	var arrived atomic.Int32
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 1; round <= 3; round++ {
+				arrived.Add(1)
+				if err := c.Barrier(ctx, "B", len(clients)); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := arrived.Load(); got < int32(round*len(clients)) {
+					t.Errorf("Client %d passed round %d after %d arrivals", c.ID, round, got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBarrierSeesWritesBufferedBeforeIt(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	writer, reader := clients[0], clients[1]
+	if err := writer.Write(ctx, "P1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Acquire(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(ctx, "P1", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := writer.Barrier(ctx, "B", 2); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := reader.Barrier(ctx, "B", 2); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "after" {
+		t.Fatalf("read %q, %v, want \"after\"", text(content), err)
+	}
+	if err := writer.Release(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBarrierMismatchIsReported(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	arrive := Message{Type: BARRIER_ARRIVE, SenderID: 9, Payload: Payload{Barrier: Barrier{Name: "B", N: 2, Round: 1}}}
+	if reason := cm.handleBarrierArrive(arrive); reason != BARRIER_WAITING {
+		t.Fatalf("got %q, want BARRIER_WAITING", reason)
+	}
+	if err := clients[0].Barrier(context.Background(), "B", 3); !errors.Is(err, ErrBarrierMismatch) {
+		t.Fatalf("got %v, want ErrBarrierMismatch", err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"sync"
+)
+
+// A Client keeps at most its capacity of pages and evicts the least recently used page once it
+// holds more. Invalidated copies are evicted first, as nobody has to be told about them.
+//
+// A READ copy is dropped and the Central Manager is told with PAGE_EVICT, so it leaves the
+// CopySet. An owned page is handed back to the Central Manager: the Central Manager takes the page
+// from the owner with PAGE_RETURN while it holds the page, and keeps it as the page's home copy
+// until a Client asks for it again, which then gets the page and its ownership. Writes the home
+// copy doesn't know about can't be lost that way. In DYNAMIC mode owned pages are not evicted,
+// as the owner is on the path of the page's faults.
+
+// touchLocked records that a page has just been used. The caller must hold the Client's lock.
+func (c *Client) touchLocked(pageNo string) {
+	c.tick++
+	c.lastUse[pageNo] = c.tick
+}
+
+// removeLocked evicts a page from the Page Copy Set. The caller must hold the Client's lock.
+func (c *Client) removeLocked(pageNo string) {
+	c.deleteLocked(pageNo)
+	c.stats.Evictions++
+}
+
+// overflowLocked starts an eviction if the Client holds more pages than its capacity.
+// The caller must hold the Client's lock.
+func (c *Client) overflowLocked() {
+	if c.capacity > 0 && len(c.PgCopySet) > c.capacity && !c.cleaning {
+		go c.evict()
+	}
+}
+
+// SetCapacity changes how many pages the Client keeps, 0 for no limit
+func (c *Client) SetCapacity(capacity int) {
+	c.mu.Lock()
+	c.capacity = capacity
+	c.mu.Unlock()
+	go c.evict()
+}
+
+// victimLocked picks the page to evict: the least recently used invalidated copy, or else the
+// least recently used page that is not in use. The caller must hold the Client's lock.
+func (c *Client) victimLocked() (string, bool) {
+	victim, found, invalid := "", false, false
+	for pageNo, page := range c.PgCopySet {
+		_, pinned := c.pinned[pageNo]
+		_, evicting := c.evicting[pageNo]
+		if page.Dirty || pinned || evicting || len(c.waiters[pageNo]) > 0 || (page.Owned && c.mode == DYNAMIC) {
+			continue
+		}
+		isInvalid := page.Access == NIL && !page.Owned
+		better := !found || (isInvalid && !invalid) || (isInvalid == invalid && c.lastUse[pageNo] < c.lastUse[victim])
+		if better {
+			victim, found, invalid = pageNo, true, isInvalid
+		}
+	}
+	return victim, found
+}
+
+// evict evicts pages until the Client holds no more than its capacity. Only one eviction runs at a time.
+func (c *Client) evict() {
+	c.mu.Lock()
+	if c.cleaning {
+		c.mu.Unlock()
+		return
+	}
+	c.cleaning = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.cleaning = false
+		c.mu.Unlock()
+	}()
+
+	for {
+		c.mu.Lock()
+		if c.capacity <= 0 || len(c.PgCopySet) <= c.capacity {
+			c.mu.Unlock()
+			return
+		}
+		pageNo, found := c.victimLocked()
+		if !found {
+			c.mu.Unlock()
+			warningcolor.Printf("Client %d holds %d pages but none can be evicted now\n", c.ID, len(c.PgCopySet))
+			return
+		}
+		page := c.PgCopySet[pageNo]
+		if page.Owned {
+			c.mu.Unlock()
+			if !c.evictOwned(pageNo) {
+				return
+			}
+			continue
+		}
+		c.removeLocked(pageNo)
+		if page.Access == NIL || c.mode != CENTRALIZED {
+			// The owner keeps the CopySet outside CENTRALIZED mode; its INVALIDATE_COPY will find nothing
+			c.mu.Unlock()
+			syscolor.Printf("Evicted Page %s\n", pageNo)
+			continue
+		}
+		// The Client doesn't ask for the page again until the Central Manager has dropped its copy
+		evicted := make(chan struct{})
+		c.evicting[pageNo] = evicted
+		c.mu.Unlock()
+		c.sendEvict(pageNo, false)
+		c.mu.Lock()
+		delete(c.evicting, pageNo)
+		close(evicted)
+		c.mu.Unlock()
+		syscolor.Printf("Evicted READ copy of Page %s\n", pageNo)
+	}
+}
+
+// evictOwned hands an owned page back to the Central Manager and reports whether it was taken
+func (c *Client) evictOwned(pageNo string) bool {
+	reply := c.sendEvict(pageNo, true)
+	switch {
+	case reply.Ack && reply.Err == "":
+		syscolor.Printf("Evicted Page %s, the Central Manager keeps it\n", pageNo)
+		return true
+	case reply.Ack && reply.Err == NOT_OWNER:
+		// The page moved on in the meantime or is in use, it is evicted another time
+		warningcolor.Printf("Client %d could not hand Page %s back now\n", c.ID, pageNo)
+		return false
+	default:
+		errcolor.Printf("Client %d could not hand Page %s back (%v), keeping it\n", c.ID, pageNo, replyError(reply))
+		return false
+	}
+}
+
+// sends a PAGE_EVICT message
+func (c *Client) sendEvict(pageNo string, owned bool) Reply {
+	evict := Message{
+		Type: PAGE_EVICT,
+		Payload: Payload{
+			Evict: Evict{
+				PgNo:  pageNo,
+				Owned: owned,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	reply := c.CallRPC(evict, CENTRALMANAGER, -1, c.cmIP(pageNo))
+	if !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(PAGE_EVICT))
+	}
+	return reply
+}
+
+// handlePageReturn hands an owned page over to the Central Manager in the reply. It reports
+// whether the Client still owned the page.
+func (c *Client) handlePageReturn(msg Message, reply *Reply) bool {
+	pageNo := msg.Payload.Evict.PgNo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, exists := c.PgCopySet[pageNo]
+	_, pinned := c.pinned[pageNo]
+	if !exists || !page.Owned || page.Dirty || pinned {
+		return false
+	}
+	c.removeLocked(pageNo)
+	reply.Page = page
+	return true
+}
+
+// awaitEvicted holds back a request for a page until the Central Manager has dropped the Client's evicted copy
+func (c *Client) awaitEvicted(pageNo string) {
+	c.mu.Lock()
+	evicted, evicting := c.evicting[pageNo]
+	c.mu.Unlock()
+	if evicting {
+		<-evicted
+	}
+}
+
+// handleEvict drops the copy of a Client that evicted it, or takes back an evicted owned page
+func (cm *CentralManager) handleEvict(msg Message) string {
+	pgNo := msg.Payload.Evict.PgNo
+	if shardOf(pgNo) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", pgNo, cm.Shard)
+		return WRONG_MANAGER
+	}
+	t := cm.queue.enter(pgNo, msg.SenderID)
+	defer cm.queue.leave(pgNo, t)
+	info, exists := cm.pageInfo(pgNo)
+	if !exists {
+		return PAGE_NOT_FOUND
+	}
+	if info.Freed {
+		return PAGE_FREED
+	}
+	if !msg.Payload.Evict.Owned {
+		info.CopySet = removePointer(info.CopySet, msg.SenderID)
+		cm.setPageInfo(pgNo, info)
+		syscolor.Printf("Client %d evicted its copy of Page %s, CopySet %v\n", msg.SenderID, pgNo, info.CopySet)
+		return ""
+	}
+	if info.Home != nil || info.Owner.ID != msg.SenderID {
+		return NOT_OWNER
+	}
+
+	pageReturn := Message{
+		Type: PAGE_RETURN,
+		Payload: Payload{
+			Evict: msg.Payload.Evict,
+		},
+	}
+	reply := cm.CallRPC(pageReturn, CLIENT, info.Owner.ID, info.Owner.IP)
+	if !reply.Ack {
+		errcolor.Printf("Client %d did not hand Page %s back\n", info.Owner.ID, pgNo)
+		return NOT_OWNER
+	}
+	home := reply.Page
+	home.Access = NIL
+	home.Owned = false
+	info.Home = &home
+	info.Owner = ClientPointer{}
+	info.Version = max(info.Version, home.Version)
+	cm.setPageInfo(pgNo, info)
+	syscolor.Printf("Client %d evicted Page %s, keeping version %d as its home copy\n", msg.SenderID, pgNo, home.Version)
+	return ""
+}
+
+// handOut gives the home copy of a page, and its ownership, to a Client that asked for it.
+// Every other copy is invalidated first. It returns the reason if it failed.
+func (cm *CentralManager) handOut(pgNo string, info PgInfo, requester ClientPointer, t *turn) string {
+	if !cm.invalidateHome(pgNo, info, requester.ID) {
+		return INVALIDATION_FAILED
+	}
+	page := *info.Home
+	page.CopySet = nil
+	pageSend := Message{
+		Type: PAGE_SEND,
+		Payload: Payload{
+			PgSend: PgSend{
+				Purpose: WRITE,
+				Page:    page,
+			},
+		},
+	}
+	sendcolor.Printf("Central Manager sending its home copy of Page %s to Client %d\n", pgNo, requester.ID)
+	if reply := cm.CallRPC(pageSend, CLIENT, requester.ID, requester.IP); !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", requester.ID, removeUnderscores(PAGE_SEND))
+		return NOT_CONFIRMED
+	}
+	info.Home = nil
+	info.Owner = requester
+	info.CopySet = []ClientPointer{}
+	cm.setPageInfo(pgNo, info)
+	return cm.awaitConfirmation(pgNo, t)
+}
+
+// invalidateHome invalidates the copies of a page the Central Manager holds, but the requester's.
+// In IMPROVED mode these are the copies the owner knew about when it handed the page back.
+func (cm *CentralManager) invalidateHome(pgNo string, info PgInfo, requesterID int) bool {
+	if cm.mode != IMPROVED {
+		return cm.invalidateCopies(pgNo, info.CopySet, requesterID)
+	}
+	invalidate := Message{
+		Type: INVALIDATE_COPY,
+		Payload: Payload{
+			InvCopy: InvCopy{
+				WriteReqID: requesterID,
+				PgNum:      pgNo,
+			},
+		},
+	}
+	var wg sync.WaitGroup
+	for _, holder := range info.Home.CopySet {
+		if holder.ID == requesterID {
+			continue
+		}
+		wg.Add(1)
+		go func(holder ClientPointer) {
+			defer wg.Done()
+			// In IMPROVED mode a holder has dropped its copy once the call returns
+			if reply := cm.CallRPC(invalidate, CLIENT, holder.ID, holder.IP); !reply.Ack {
+				warningcolor.Printf("Central Manager could not invalidate Page %s at Client %d\n", pgNo, holder.ID)
+			}
+		}(holder)
+	}
+	wg.Wait()
+	return true
+}
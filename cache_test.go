@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// settled waits until the Central Manager's info of pgNo satisfies cond and returns it
+func settled(t *testing.T, cm *CentralManager, pgNo string, cond func(info PgInfo) bool) PgInfo {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if info, _ := cm.pageInfo(pgNo); cond(info) {
+			return info
+		}
+	}
+	info, _ := cm.pageInfo(pgNo)
+	t.Fatalf("info of %s never settled, it is %+v", pgNo, info)
+	return info
+}
+
+// holding waits until a Client holds at most n pages
+func holding(t *testing.T, c *Client, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		held := len(c.PgCopySet)
+		c.mu.Unlock()
+		if held <= n {
+			return
+		}
+	}
+	t.Fatalf("Client %d never got down to %d pages", c.ID, n)
+}
+
+func TestLeastRecentlyUsedPageIsEvicted(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	c := clients[0]
+	c.SetCapacity(3)
+	for _, pageNo := range []string{"P1", "P2", "P3"} {
+		if err := c.Write(ctx, pageNo, []byte(pageNo)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(ctx, "P4", []byte("P4")); err != nil {
+		t.Fatal(err)
+	}
+	holding(t, c, 3)
+	if _, held := c.page("P2"); held {
+		t.Fatal("P2 kept, want the least recently used page evicted")
+	}
+	if c.Stats().Evictions != 1 {
+		t.Fatalf("%d evictions, want 1", c.Stats().Evictions)
+	}
+	// The owner handed the page back, the Central Manager keeps it until somebody asks for it
+	info := settled(t, cm, "P2", func(info PgInfo) bool { return info.Home != nil })
+	if text(info.Home.Content) != "P2" || info.Owner.ID != 0 {
+		t.Fatalf("page info %+v, want the evicted page kept without an owner", info)
+	}
+	if content, err := clients[1].Read(ctx, "P2"); err != nil || text(content) != "P2" {
+		t.Fatalf("read %q, %v, want \"P2\"", text(content), err)
+	}
+	// The page and its ownership go to the first Client that asks for it
+	settled(t, cm, "P2", func(info PgInfo) bool { return info.Home == nil && info.Owner.ID == 2 })
+}
+
+func TestEvictedPagesReadBackCorrectly(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	for _, c := range clients {
+		c.SetCapacity(3)
+	}
+	for i := range 8 {
+		pageNo := fmt.Sprint("P", i)
+		if err := clients[i%2].Write(ctx, pageNo, []byte(pageNo)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := range 2 {
+		for i := range 8 {
+			pageNo := fmt.Sprint("P", i)
+			c := clients[(i+round)%2]
+			if content, err := c.Read(ctx, pageNo); err != nil || text(content) != pageNo {
+				t.Fatalf("Client %d read %q, %v, want %q", c.ID, text(content), err, pageNo)
+			}
+		}
+	}
+	for _, c := range clients {
+		holding(t, c, 3)
+	}
+}
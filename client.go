@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,17 +19,150 @@ const (
 	NIL       = "NIL"
 )
 
+// Coherence policies of a page
+const (
+	INVALIDATE = "INVALIDATE" // a write invalidates every copy of the page
+	UPDATE     = "UPDATE"     // a write pushes the new content to every copy of the page
+	MULTIPLE   = "MULTIPLE"   // writes are sent to the owner as diffs and invalidate every copy, the owner stays
+)
+
+// REQUEST_TIMEOUT is how long a REPL or generated request waits for its page, retries included
+const REQUEST_TIMEOUT = 15 * time.Second
+
+// RetryPolicy controls how a Client re-sends a request whose page never arrives
+type RetryPolicy struct {
+	AttemptTimeout time.Duration // how long to wait for PAGE_SEND before re-sending
+	MaxRetries     int           // how many times a request is re-sent before giving up
+	Backoff        time.Duration // wait before the first retry, doubled after every retry
+	MaxBackoff     time.Duration // upper bound of the wait between retries
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	AttemptTimeout: 2 * time.Second,
+	MaxRetries:     4,
+	Backoff:        250 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+var (
+	ErrPageNotFound     = errors.New("central manager doesn't have the page")
+	ErrPageFreed        = errors.New("page has been freed")
+	ErrOwnerUnreachable = errors.New("page owner could not be reached")
+	ErrNotAcknowledged  = errors.New("central manager did not acknowledge the request")
+	ErrInvalidation     = errors.New("copies of the page could not be invalidated")
+	ErrNotConfirmed     = errors.New("central manager did not record the new owner")
+	ErrWrongManager     = errors.New("central manager doesn't manage the page")
+	ErrNotLockHolder    = errors.New("lock is not held by this client")
+	ErrBarrierMismatch  = errors.New("clients disagree on how many arrive at the barrier")
+	ErrTimeout          = errors.New("request timed out")
+	ErrPageOverflow     = errors.New("content doesn't fit in a page")
+
+	errCMChanged      = errors.New("central manager changed")
+	errStaleDuplicate = errors.New("request already served but the page is gone")
+	errMultipleWriter = errors.New("page has multiple writers")
+)
+
+// PageError is returned when a read or write on a page fails
+type PageError struct {
+	Op   string
+	PgNo string
+	Err  error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("%s page %s: %v", e.Op, e.PgNo, e.Err)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
 type Page struct {
 	PageId  string
-	Content string
+	Content []byte // always PageSize bytes, never changed in place once stored
 	Access  string
+	Version int             // incremented by every write
+	Owned   bool            // whether this Client is the page's owner
+	CopySet []ClientPointer // Clients holding a READ copy, kept by the owner in DYNAMIC and IMPROVED mode and for UPDATE pages
+	Policy  string          // INVALIDATE, UPDATE or MULTIPLE
+	Dirty   bool            // written while holding a lock and not written back yet
+	Twin    []byte          // content of a dirty page before its first buffered write
+}
+
+// newPage returns an empty page, PageSize zero bytes
+func newPage(pageNo string, policy string) Page {
+	return Page{PageId: pageNo, Content: make([]byte, PageSize), Policy: policy}
+}
+
+// fit returns content padded with zeros to PageSize bytes
+func fit(content []byte) ([]byte, error) {
+	if len(content) > PageSize {
+		return nil, ErrPageOverflow
+	}
+	page := make([]byte, PageSize)
+	copy(page, content)
+	return page, nil
+}
+
+// text returns the content of a page as text, without the zeros that pad it
+func text(content []byte) string {
+	return string(bytes.TrimRight(content, "\x00"))
 }
 
 type Client struct {
-	ID               int
-	IP               string
-	PgCopySet        map[string]Page
-	CentralManagerIP string
+	ID                int
+	IP                string
+	PgCopySet         map[string]Page
+	CentralManagerIPs []string // primary Central Manager of every shard, indexed by shard
+
+	mu        *sync.Mutex
+	mode      string
+	waiters   map[string][]*pageWaiter
+	cmChange  chan struct{}
+	retry     RetryPolicy
+	seq       uint64 // starts from the clock so that a restarted Client doesn't reuse request IDs
+	stats     ClientStats
+	queue     *pageQueue               // faults waiting to be served by this Client in DYNAMIC mode
+	probOwner map[string]ClientPointer // where each page's owner was last heard to be in DYNAMIC mode
+	locks     map[string]chan struct{} // locks held, closed on release to stop renewing the lease; while there are any writes are buffered
+	grants    map[string]chan struct{} // locks being waited for
+
+	barrierRounds map[string]int          // how many times the Client has entered each barrier
+	barrierWaits  map[string]*barrierWait // barriers being waited at
+
+	pinned  map[string]chan struct{} // pages held by a committing transaction, closed when they are let go
+	commits *sync.Mutex              // held while a transaction commits
+
+	capacity int                      // how many pages the Client keeps before evicting, 0 for no limit
+	lastUse  map[string]uint64        // tick of the last use of every page
+	tick     uint64                   // counts page uses
+	evicting map[string]chan struct{} // READ copies whose eviction the Central Manager hasn't seen yet
+	cleaning bool                     // whether an eviction is running
+
+	store *pageStore // the owned pages kept on disk, nil without PageStore
+}
+
+// ClientStats counts how the Client's reads were served
+type ClientStats struct {
+	ReadHits   int // reads served from a valid local copy
+	ReadMisses int // reads that faulted to the Central Manager
+	FaultHops  int // how many times this Client's faults were forwarded before reaching the owner
+	Forwards   int // faults of other Clients passed on by this Client
+	Evictions  int // pages dropped to keep the Client within its capacity
+}
+
+// pageWaiter is a caller waiting for a PAGE_SEND of a page.
+// A READ waiter is satisfied by any PAGE_SEND, a WRITE waiter only by one for WRITE.
+type pageWaiter struct {
+	purpose string
+	apply   func(Page) Page // the write to make to a page received for WRITE
+	arrived chan arrival
+}
+
+// arrival is a page received with PAGE_SEND and whether the Central Manager acknowledged its confirmation
+type arrival struct {
+	page      Page
+	confirmed bool
 }
 
 type ClientPointer struct {
@@ -32,6 +170,33 @@ type ClientPointer struct {
 	IP string
 }
 
+// newClient creates a Client with an empty Page Copy Set
+func newClient(id int, ip string, cmIPs []string) *Client {
+	return &Client{
+		ID:                id,
+		IP:                ip,
+		PgCopySet:         make(map[string]Page),
+		CentralManagerIPs: cmIPs,
+		mu:                &sync.Mutex{},
+		mode:              ManagerMode,
+		waiters:           map[string][]*pageWaiter{},
+		cmChange:          make(chan struct{}),
+		retry:             DefaultRetryPolicy,
+		seq:               uint64(time.Now().UnixNano()),
+		queue:             newPageQueue(),
+		probOwner:         map[string]ClientPointer{},
+		locks:             map[string]chan struct{}{},
+		grants:            map[string]chan struct{}{},
+		barrierRounds:     map[string]int{},
+		barrierWaits:      map[string]*barrierWait{},
+		pinned:            map[string]chan struct{}{},
+		commits:           &sync.Mutex{},
+		capacity:          CacheCapacity,
+		lastUse:           map[string]uint64{},
+		evicting:          map[string]chan struct{}{},
+	}
+}
+
 // Utility function to remove underscores
 func removeUnderscores(s string) string {
 	return strings.ReplaceAll(s, "_", " ")
@@ -42,55 +207,110 @@ func (c *Client) HandleIncMsg(msg Message, reply *Reply) error {
 	reccolor.Printf("Message of Type '%s' received\n", removeUnderscores(msg.Type))
 	switch msg.Type {
 	case READ_FORWARD:
-		c.HandleReadFrd(msg)
-		reply.Ack = true
+		reply.Ack = c.HandleReadFrd(msg)
 	case PAGE_SEND:
-		c.HandlePgSend(msg)
-		reply.Ack = true
+		reply.Ack = c.HandlePgSend(msg)
 	case INVALIDATE_COPY:
-		reply.Ack = c.handleInvalidate(msg)
-	case WRITE_FORWARD:
-		c.handleWriteForward(msg)
+		c.handleInvalidate(msg)
 		reply.Ack = true
+	case WRITE_FORWARD:
+		reply.Ack = c.handleWriteForward(msg)
 	case CHANGE_CM:
 		c.handleChangeCentralManager(msg)
 		reply.Ack = true
+	case PAGE_FAULT:
+		*reply = c.handleFault(msg)
+	case PAGE_UPDATE:
+		c.handlePageUpdate(msg)
+		reply.Ack = true
+	case LOCK_GRANT:
+		reply.Ack = c.handleLockGrant(msg)
+	case BARRIER_RELEASE:
+		c.handleBarrierRelease(msg)
+		reply.Ack = true
+	case DIFF_FORWARD:
+		reply.Ack = c.handleDiffForward(msg)
+	case PAGE_RETURN:
+		reply.Ack = c.handlePageReturn(msg, reply)
 	}
 	return nil
 }
 
-// HandleReadFrd handles a READ_FORWARD message
-func (c *Client) HandleReadFrd(msg Message) {
+// HandleReadFrd handles a READ_FORWARD message. It reports whether the Client had the page
+// to send; an owner that no longer holds it sends nothing.
+// The owner gives up write access while the reader holds a copy, so its next write
+// has to go through the Central Manager and invalidate that copy first.
+// In IMPROVED mode the owner also adds the reader to the page's CopySet.
+func (c *Client) HandleReadFrd(msg Message) bool {
 	reqPgNo := msg.Payload.ReadForward.PgNo
-	reqPg := c.PgCopySet[reqPgNo]
+	readReqID := msg.Payload.ReadForward.ReadReqID
+	readReqIP := msg.Payload.ReadForward.ReadReqIP
+	if readReqID != c.ID {
+		c.lockUnpinned(reqPgNo)
+	} else {
+		c.mu.Lock()
+	}
+	reqPg, exists := c.PgCopySet[reqPgNo]
+	if !exists {
+		c.mu.Unlock()
+		errcolor.Printf("Page %s doesn't exist in Client %d's PgCopySet. Cannot serve the read\n", reqPgNo, c.ID)
+		return false
+	}
+	if reqPg.Access == READWRITE {
+		reqPg.Access = READ
+		syscolor.Printf("Downgraded Page %s to %s access\n", reqPgNo, READ)
+	}
+	if c.mode == IMPROVED && readReqID != c.ID {
+		reqPg.CopySet = addPointer(reqPg.CopySet, ClientPointer{ID: readReqID, IP: readReqIP})
+	}
+	c.putLocked(reqPg)
+	c.mu.Unlock()
 	pgSendMsg := Message{
 		Type: PAGE_SEND,
 		Payload: Payload{
 			PgSend: PgSend{
 				Purpose: READ,
-				Page:    reqPg,
+				Page:    released(reqPg),
 			}},
 		SenderID: c.ID,
 		SenderIP: c.IP,
 	}
-	readReqID := msg.Payload.ReadForward.ReadReqID
-	readReqIP := msg.Payload.ReadForward.ReadReqIP
 	sendcolor.Printf("Client %d sending Msg '%s' to Client %d\n", c.ID, removeUnderscores(PAGE_SEND), readReqID)
 	reply := c.CallRPC(pgSendMsg, CLIENT, readReqID, readReqIP)
 	if !reply.Ack {
 		errcolor.Printf("Msg '%s' from Client %d not acknowledged by Client %d\n", removeUnderscores(pgSendMsg.Type), c.ID, readReqID)
-		return
 	}
+	return true
 }
 
-// HandlePgSend handles a PAGE_SEND message
-func (c *Client) HandlePgSend(msg Message) {
+// HandlePgSend handles a PAGE_SEND message. It reports whether the page was accepted;
+// a copy for READ that is older than the one already held is refused.
+func (c *Client) HandlePgSend(msg Message) bool {
 	sentPgNo := msg.Payload.PgSend.Page.PageId
-	sentPg := msg.Payload.PgSend.Page
 	why := msg.Payload.PgSend.Purpose
 
+	// The copy is stored, and pending writes are made to it, before confirming. An invalidation
+	// that follows the confirmation then finds the copy, and the page can't be forwarded to
+	// another writer before this Client's writes are in.
+	sentPg, waiters, accepted := c.receive(msg.Payload.PgSend.Page, why)
+	if !accepted {
+		warningcolor.Printf("Client %d sent an old version %d of Page %s, refused\n", msg.SenderID, msg.Payload.PgSend.Page.Version, sentPgNo)
+		return false
+	}
+	if c.mode == DYNAMIC {
+		// The owner hands pages over itself, there is no Central Manager to confirm to
+		c.mu.Lock()
+		c.stats.FaultHops += msg.Payload.PgSend.Hops
+		c.mu.Unlock()
+		if why == READ {
+			c.setProbOwner(sentPgNo, ClientPointer{ID: msg.SenderID, IP: msg.SenderIP})
+		} else {
+			c.setProbOwner(sentPgNo, ClientPointer{ID: c.ID, IP: c.IP})
+		}
+		notify(waiters, sentPg, true)
+		return true
+	}
 	if why == READ {
-		sentPg.Access = READ
 		readConf := Message{
 			Type: READ_CONFIRMATION,
 			Payload: Payload{
@@ -100,17 +320,22 @@ func (c *Client) HandlePgSend(msg Message) {
 					ReadReqIP: c.IP,
 					SenderID:  msg.SenderID,
 					SenderIP:  msg.SenderIP,
+					Version:   sentPg.Version,
 				},
 			},
 		}
-		reply := c.CallRPC(readConf, CENTRALMANAGER, -1, c.CentralManagerIP)
+		reply := c.CallRPC(readConf, CENTRALMANAGER, -1, c.cmIP(sentPgNo))
 		if !reply.Ack {
 			errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(READ_CONFIRMATION))
-			return
+			// The Central Manager won't invalidate a copy it doesn't know about
+			c.invalidate(sentPgNo)
 		}
+		notify(waiters, sentPg, reply.Ack)
 
 	} else if why == WRITE {
-		sentPg.Access = READWRITE
+		// Copies of an UPDATE page get the new content before the write is confirmed,
+		// so the next write can't overtake it
+		copySet := c.pushUpdates(sentPg)
 		writeConf := Message{
 			Type: WRITE_CONFIRMATION,
 			Payload: Payload{
@@ -118,67 +343,270 @@ func (c *Client) HandlePgSend(msg Message) {
 					PgNum:    sentPgNo,
 					WriterID: c.ID,
 					WriterIP: c.IP,
+					Version:  sentPg.Version,
+					CopySet:  copySet,
 				},
 			},
 		}
-		reply := c.CallRPC(writeConf, CENTRALMANAGER, -1, c.CentralManagerIP)
+		reply := c.CallRPC(writeConf, CENTRALMANAGER, -1, c.cmIP(sentPgNo))
 		if !reply.Ack {
 			errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(WRITE_CONFIRMATION))
-			return
+			// The Central Manager has moved on, another Client may own the page by now
+			c.invalidate(sentPgNo)
 		}
+		notify(waiters, sentPg, reply.Ack)
 	}
-	c.PgCopySet[sentPgNo] = sentPg
+	return true
 }
 
 // handles an INVALIDATE_COPY message
-func (c *Client) handleInvalidate(msg Message) bool {
+func (c *Client) handleInvalidate(msg Message) {
 	targetPageNo := msg.Payload.InvCopy.PgNum
-	targetPage, exists := c.PgCopySet[targetPageNo]
-	if !exists {
-		errcolor.Printf("Page %s doesn't exist in Node %d's PgCopySet. Cannot invalidate", targetPageNo, c.ID)
-		return false
+	if msg.Payload.InvCopy.Freed {
+		// The Central Manager waits for the call itself
+		c.dropFreed(targetPageNo)
+		return
 	}
-	targetPage.Access = NIL
-	c.PgCopySet[targetPageNo] = targetPage
-	return true
+	if !c.invalidate(targetPageNo) {
+		warningcolor.Printf("Page %s doesn't exist in Node %d's PgCopySet. Nothing to invalidate\n", targetPageNo, c.ID)
+	}
+	switch c.mode {
+	case DYNAMIC:
+		// The owner waits for the call itself and tells where the page is going
+		c.setProbOwner(targetPageNo, msg.Payload.InvCopy.NewOwner)
+		return
+	case IMPROVED:
+		// The owner waits for the call itself
+		return
+	}
+	// Confirm once the INVALIDATE_COPY call has returned, the Central Manager waits for it separately
+	go c.sendInvConfirm(targetPageNo, msg.Payload.InvCopy.WriteReqID)
+}
+
+// sends an INVALIDATE_CONFIRMATION message
+func (c *Client) sendInvConfirm(pageNo string, writeReqID int) {
+	invConfirm := Message{
+		Type: INVALIDATE_CONFIRMATION,
+		Payload: Payload{
+			InvConfirm: InvConfirm{
+				WriteReqID: writeReqID,
+				PgNum:      pageNo,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	reply := c.CallRPC(invConfirm, CENTRALMANAGER, -1, c.cmIP(pageNo))
+	if !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(INVALIDATE_CONFIRMATION))
+	}
+}
+
+// invalidateHolders is used by an owner that keeps its page's copies itself. It sends INVALIDATE_COPY
+// to every holder but the new owner and waits for them. Holders that can't be reached are skipped,
+// they fault again when they come back.
+func (c *Client) invalidateHolders(pageNo string, holders []ClientPointer, newOwner ClientPointer) {
+	invalidate := Message{
+		Type: INVALIDATE_COPY,
+		Payload: Payload{
+			InvCopy: InvCopy{
+				WriteReqID: newOwner.ID,
+				PgNum:      pageNo,
+				NewOwner:   newOwner,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	var wg sync.WaitGroup
+	for _, holder := range holders {
+		if holder.ID == newOwner.ID || holder.ID == c.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(holder ClientPointer) {
+			defer wg.Done()
+			if reply := c.CallRPC(invalidate, CLIENT, holder.ID, holder.IP); !reply.Ack {
+				warningcolor.Printf("Client %d could not invalidate Page %s at Client %d\n", c.ID, pageNo, holder.ID)
+			}
+		}(holder)
+	}
+	wg.Wait()
+}
+
+// pushUpdates sends the content of an UPDATE page that has just been written to the holders of its
+// copies. Holders that can't be reached are dropped from the CopySet, which is returned.
+func (c *Client) pushUpdates(page Page) []ClientPointer {
+	if page.Policy != UPDATE || len(page.CopySet) == 0 {
+		return page.CopySet
+	}
+	update := Message{
+		Type: PAGE_UPDATE,
+		Payload: Payload{
+			PgUpdate: PgUpdate{
+				Page: page,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	copySet := []ClientPointer{}
+	for _, holder := range page.CopySet {
+		wg.Add(1)
+		go func(holder ClientPointer) {
+			defer wg.Done()
+			if reply := c.CallRPC(update, CLIENT, holder.ID, holder.IP); !reply.Ack {
+				warningcolor.Printf("Client %d could not update Page %s at Client %d, dropping its copy\n", c.ID, page.PageId, holder.ID)
+				return
+			}
+			mu.Lock()
+			copySet = append(copySet, holder)
+			mu.Unlock()
+		}(holder)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held, exists := c.PgCopySet[page.PageId]; exists && held.Version == page.Version {
+		held.CopySet = copySet
+		c.putLocked(held)
+	}
+	return copySet
+}
+
+// handlePageUpdate handles a PAGE_UPDATE message by refreshing the Client's READ copy of the page
+func (c *Client) handlePageUpdate(msg Message) {
+	update := msg.Payload.PgUpdate.Page
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	held, exists := c.PgCopySet[update.PageId]
+	if !exists || held.Access != READ || held.Dirty || held.Version >= update.Version {
+		warningcolor.Printf("Client %d has no older READ copy of Page %s to update\n", c.ID, update.PageId)
+		return
+	}
+	held.Content = update.Content
+	held.Version = update.Version
+	c.putLocked(held)
+	syscolor.Printf("Page %s updated to version %d by Client %d\n", update.PageId, update.Version, msg.SenderID)
+}
+
+// addPointer adds a Client to a CopySet unless it is already in it
+func addPointer(copySet []ClientPointer, client ClientPointer) []ClientPointer {
+	for _, holder := range copySet {
+		if holder.ID == client.ID {
+			return copySet
+		}
+	}
+	return append(copySet, client)
+}
+
+// removePointer returns a CopySet without a Client
+func removePointer(copySet []ClientPointer, id int) []ClientPointer {
+	kept := []ClientPointer{}
+	for _, holder := range copySet {
+		if holder.ID != id {
+			kept = append(kept, holder)
+		}
+	}
+	return kept
 }
 
-// handles a WRITE_FORWARD message
-func (c *Client) handleWriteForward(msg Message) {
+// handles a WRITE_FORWARD message by handing the page and its ownership to the writer.
+// It reports whether the page could be handed over.
+func (c *Client) handleWriteForward(msg Message) bool {
 	writeReqID := msg.Payload.WriteForward.WriteReqID
 	writeReqIP := msg.Payload.WriteForward.WriteReqIP
 	ReqPg := msg.Payload.WriteForward.PgNum
-	content := msg.Payload.WriteForward.Content
+	writer := ClientPointer{ID: writeReqID, IP: writeReqIP}
+	if writeReqID != c.ID {
+		c.lockUnpinned(ReqPg)
+	} else {
+		c.mu.Lock()
+	}
 	page, exists := c.PgCopySet[ReqPg]
-	page.Access = NIL
-	page.Content = content
-	c.PgCopySet[ReqPg] = page
-
 	if !exists {
-		errcolor.Printf("Client %d req to write Page %s does not exist in Client %d's PgCopySet", writeReqID, ReqPg, c.ID)
-		return
+		c.mu.Unlock()
+		errcolor.Printf("Client %d req to write Page %s does not exist in Client %d's PgCopySet\n", writeReqID, ReqPg, c.ID)
+		return false
 	}
+	copySet := page.CopySet
+	if c.mode != IMPROVED {
+		copySet = msg.Payload.WriteForward.CopySet
+	}
+	kept := page
+	kept.Access = NIL
+	kept.Owned = false
+	kept.CopySet = nil
+	if page.Policy == UPDATE && writeReqID != c.ID {
+		// The old owner keeps its copy and the writer updates it along with the others
+		kept.Access = READ
+		copySet = addPointer(copySet, ClientPointer{ID: c.ID, IP: c.IP})
+	}
+	c.putLocked(kept)
+	c.mu.Unlock()
+
+	page.CopySet = nil
+	if page.Policy == UPDATE {
+		page.CopySet = removePointer(copySet, writeReqID)
+	} else if c.mode == IMPROVED {
+		// The Central Manager doesn't know the copies, so the owner invalidates them before handing over
+		c.invalidateHolders(ReqPg, copySet, writer)
+	}
+
 	pageSend := Message{
 		Type: PAGE_SEND,
 		Payload: Payload{
 			PgSend: PgSend{
 				Purpose: WRITE,
-				Page:    page,
+				Page:    released(page),
 			},
 		},
 		SenderID: c.ID,
 		SenderIP: c.IP,
 	}
+	// An owner that downgraded to READ asks for its own page back
+	if writeReqID == c.ID {
+		return c.HandlePgSend(pageSend)
+	}
 	sendcolor.Printf("Client %d sending Msg %s to Client %d\n", c.ID, removeUnderscores(PAGE_SEND), writeReqID)
 	reply := c.CallRPC(pageSend, CLIENT, writeReqID, writeReqIP)
 	if !reply.Ack {
-		errcolor.Printf("Msg '%s' from Client %d not acknowledged by Client %d\n", removeUnderscores(INVALIDATE_CONFIRMATION), c.ID, writeReqID)
-		return
+		errcolor.Printf("Msg '%s' from Client %d not acknowledged by Client %d\n", removeUnderscores(PAGE_SEND), c.ID, writeReqID)
+	}
+	return true
+}
+
+// Read returns a copy of the PageSize bytes of a page. A valid local copy, or one with buffered
+// writes, is served directly, otherwise the page is faulted in from its owner through the Central Manager.
+func (c *Client) Read(ctx context.Context, pageNo string) ([]byte, error) {
+	page, err := c.read(ctx, pageNo)
+	if err != nil {
+		return nil, err
 	}
+	return bytes.Clone(page.Content), nil
+}
+
+// read returns the page Read serves, so that its content and version belong together
+func (c *Client) read(ctx context.Context, pageNo string) (Page, error) {
+	c.mu.Lock()
+	page, exists := c.PgCopySet[pageNo]
+	if exists && (page.Access == READ || page.Access == READWRITE || page.Dirty) {
+		c.stats.ReadHits++
+		c.touchLocked(pageNo)
+		c.mu.Unlock()
+		return page, nil
+	}
+	c.stats.ReadMisses++
+	c.mu.Unlock()
+
+	return c.fault(ctx, "read", pageNo, READ, nil, c.requester(pageNo, READ, ""))
 }
 
 // sends a READ_REQUEST message
-func (c *Client) sendReadReq(pageNo string) {
+func (c *Client) sendReadReq(pageNo string, seq uint64) Reply {
 	readRequest := Message{
 		Type: READ_REQUEST,
 		Payload: Payload{
@@ -188,58 +616,496 @@ func (c *Client) sendReadReq(pageNo string) {
 		},
 		SenderID: c.ID,
 		SenderIP: c.IP,
+		Seq:      seq,
 	}
 
-	reply := c.CallRPC(readRequest, CENTRALMANAGER, -1, c.CentralManagerIP)
+	reply := c.CallRPC(readRequest, CENTRALMANAGER, -1, c.cmIP(pageNo))
 	if !reply.Ack {
 		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(READ_REQUEST))
 	}
+	return reply
 }
 
-// sends a WRITE_REQUEST message
-func (c *Client) sendWriteReq(pageNo string, content string) {
+// replyError converts a Central Manager's reply into an error
+func replyError(reply Reply) error {
+	if !reply.Ack {
+		return ErrNotAcknowledged
+	}
+	switch reply.Err {
+	case "":
+		return nil
+	case PAGE_NOT_FOUND:
+		return ErrPageNotFound
+	case PAGE_FREED:
+		return ErrPageFreed
+	case OWNER_UNREACHABLE:
+		return ErrOwnerUnreachable
+	case INVALIDATION_FAILED:
+		return ErrInvalidation
+	case NOT_CONFIRMED:
+		return ErrNotConfirmed
+	case WRONG_MANAGER:
+		return ErrWrongManager
+	case NOT_LOCK_HOLDER:
+		return ErrNotLockHolder
+	case BARRIER_MISMATCH:
+		return ErrBarrierMismatch
+	case MULTIPLE_WRITER:
+		return errMultipleWriter
+	default:
+		return errors.New(removeUnderscores(reply.Err))
+	}
+}
+
+// Write sets the content of a page, padded with zeros to PageSize bytes. It returns once the Client
+// holds the page with READWRITE access and the Central Manager has recorded it as the owner.
+func (c *Client) Write(ctx context.Context, pageNo string, content []byte) error {
+	return c.WriteWithPolicy(ctx, pageNo, content, "")
+}
+
+// WriteWithPolicy is Write that creates a missing page with a coherence policy, INVALIDATE, UPDATE or MULTIPLE.
+// The policy of a page that already exists is not changed.
+func (c *Client) WriteWithPolicy(ctx context.Context, pageNo string, content []byte, policy string) error {
+	page, err := fit(content)
+	if err != nil {
+		return &PageError{Op: "write", PgNo: pageNo, Err: err}
+	}
+	return c.update(ctx, pageNo, policy, func(content []byte) {
+		copy(content, page)
+	})
+}
+
+// Update changes the PageSize bytes of a page in place with fn. fn runs while the Client
+// holds the page with READWRITE access and before ownership can move on, so no other write
+// comes in between. fn must not call back into the Client or keep content.
+// On a MULTIPLE page fn runs on the Client's copy, and only the parts it changes are written.
+func (c *Client) Update(ctx context.Context, pageNo string, fn func(content []byte)) error {
+	return c.update(ctx, pageNo, "", fn)
+}
+
+// update is Update with the policy of the page if the write creates it.
+// While the Client holds a lock the write is buffered until the lock is released.
+func (c *Client) update(ctx context.Context, pageNo string, policy string, fn func(content []byte)) error {
+	if c.inSection() {
+		return c.bufferWrite(ctx, pageNo, policy, fn)
+	}
+	if page, exists := c.page(pageNo); exists && page.Policy == MULTIPLE && page.Access != READWRITE {
+		return c.writeDiff(ctx, pageNo, fn)
+	}
+	err := c.writeThrough(ctx, pageNo, policy, fn)
+	if errors.Is(err, errMultipleWriter) {
+		return c.writeDiff(ctx, pageNo, fn)
+	}
+	return err
+}
+
+// writeThrough makes a write to the page itself, faulting it in for WRITE if needed
+func (c *Client) writeThrough(ctx context.Context, pageNo string, policy string, fn func(content []byte)) error {
+	apply := func(page Page) Page {
+		page.Content = bytes.Clone(page.Content)
+		fn(page.Content)
+		page.Version++
+		page.Dirty = false
+		page.Twin = nil
+		return page
+	}
+
+	c.mu.Lock()
 	page, exists := c.PgCopySet[pageNo]
 	// If the page already exists
 	if exists {
 		// If the page is already stored in the Central Manager
 		if page.Access == READWRITE {
 			syscolor.Printf("You already have %s access to page %s\n", page.Access, pageNo)
-			page.Content = content
-			c.PgCopySet[pageNo] = page
-			return
+			c.putLocked(apply(page))
+			c.touchLocked(pageNo)
+			c.mu.Unlock()
+			return nil
 		} else {
 			syscolor.Printf("Page %s exists and you have %s access\n", pageNo, page.Access)
 		}
 	} else {
 		syscolor.Printf("Page %s does not exist but you can create one\n", pageNo)
 	}
+	c.mu.Unlock()
+
+	_, err := c.fault(ctx, "write", pageNo, WRITE, apply, c.requester(pageNo, WRITE, policy))
+	return err
+}
+
+// requester returns how a fault on a page is sent in the Client's mode
+func (c *Client) requester(pageNo string, purpose string, policy string) func(seq uint64) Reply {
+	switch {
+	case c.mode == DYNAMIC:
+		return func(seq uint64) Reply {
+			return c.sendFault(pageNo, purpose, seq)
+		}
+	case purpose == READ:
+		return func(seq uint64) Reply {
+			return c.sendReadReq(pageNo, seq)
+		}
+	default:
+		return func(seq uint64) Reply {
+			return c.sendWriteReq(pageNo, policy, seq)
+		}
+	}
+}
+
+// fault sends a request with send until a PAGE_SEND for purpose arrives. The request is
+// re-sent, to whichever Central Manager the Client knows about at that moment, when it isn't
+// acknowledged, when no page arrives within the attempt timeout, or when a new Central Manager
+// is installed while it waits. Denials from the Central Manager are not retried.
+// Every attempt carries the same sequence number so the Central Manager runs the request once,
+// and the Client waits for the page across all of them, so a page sent for an earlier attempt
+// still settles the fault. apply is the write to make to the page if it arrives for WRITE.
+func (c *Client) fault(ctx context.Context, op string, pageNo string, purpose string, apply func(Page) Page, send func(seq uint64) Reply) (Page, error) {
+	c.awaitEvicted(pageNo)
+	policy := c.retryPolicy()
+	backoff := policy.Backoff
+	seq := c.nextSeq()
+	waiter := c.expect(pageNo, purpose, apply)
+	defer c.forget(pageNo, waiter)
+	for attempt := 0; ; attempt++ {
+		// A page that arrived unconfirmed took the waiter with it
+		c.register(pageNo, waiter)
+		page, retry, err := c.attempt(ctx, pageNo, waiter, policy.AttemptTimeout, func() Reply {
+			return send(seq)
+		})
+		if err == nil {
+			return page, nil
+		}
+		if !retry || attempt >= policy.MaxRetries {
+			return Page{}, &PageError{Op: op, PgNo: pageNo, Err: err}
+		}
+		warningcolor.Printf("Retrying %s of Page %s (%v), retry %d of %d\n", op, pageNo, err, attempt+1, policy.MaxRetries)
+		if err == errStaleDuplicate {
+			// The read was served but its copy is gone, so this is a new request
+			seq = c.nextSeq()
+		}
+		if err == errCMChanged {
+			continue
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return Page{}, &PageError{Op: op, PgNo: pageNo, Err: ErrTimeout}
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+	}
+}
+
+// attempt sends a request once and waits for its page. It reports whether a failed request should be re-sent.
+func (c *Client) attempt(ctx context.Context, pageNo string, waiter *pageWaiter, timeout time.Duration, send func() Reply) (Page, bool, error) {
+	select {
+	case arrival := <-waiter.arrived:
+		// The page of an earlier attempt arrived while the Client backed off
+		return settle(waiter, arrival)
+	default:
+	}
+	cmChanged := c.cmChanged()
+	replies := make(chan Reply, 1)
+	go func() {
+		replies <- send()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case arrival := <-waiter.arrived:
+			return settle(waiter, arrival)
+		case reply := <-replies:
+			if !reply.Ack {
+				return Page{}, true, ErrNotAcknowledged
+			}
+			if reply.Err == NOT_CONFIRMED {
+				return Page{}, true, ErrNotConfirmed
+			}
+			if err := replyError(reply); err != nil {
+				return Page{}, false, err
+			}
+			if reply.Duplicate && waiter.purpose == READ {
+				select {
+				case arrival := <-waiter.arrived:
+					return settle(waiter, arrival)
+				default:
+					return c.replayed(pageNo)
+				}
+			}
+			// A WRITE is only settled by its page, as the write is made to it when it arrives
+			replies = nil
+		case <-cmChanged:
+			return Page{}, true, errCMChanged
+		case <-timer.C:
+			return Page{}, true, ErrTimeout
+		case <-ctx.Done():
+			return Page{}, false, ErrTimeout
+		}
+	}
+}
+
+// settle returns the page that arrived for a waiter. A page for WRITE whose confirmation
+// the Central Manager didn't acknowledge has to be asked for again.
+func settle(waiter *pageWaiter, arrival arrival) (Page, bool, error) {
+	if waiter.purpose == WRITE && !arrival.confirmed {
+		return Page{}, true, ErrNotConfirmed
+	}
+	return arrival.page, false, nil
+}
+
+// sends a WRITE_REQUEST message
+func (c *Client) sendWriteReq(pageNo string, policy string, seq uint64) Reply {
 	writeRequest := Message{
 		Type: WRITE_REQUEST,
 		Payload: Payload{
 			WriteReq: WriteReq{
-				PgNo:    pageNo,
-				Content: content,
+				PgNo:   pageNo,
+				Policy: policy,
 			},
 		},
 		SenderID: c.ID,
 		SenderIP: c.IP,
+		Seq:      seq,
 	}
 
-	reply := c.CallRPC(writeRequest, CENTRALMANAGER, -1, c.CentralManagerIP)
+	reply := c.CallRPC(writeRequest, CENTRALMANAGER, -1, c.cmIP(pageNo))
 	if !reply.Ack {
-		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(READ_REQUEST))
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(WRITE_REQUEST))
+	}
+	return reply
+}
+
+// replayed settles a READ the Central Manager had already served before this attempt. Its copy
+// was stored when it arrived, unless a newer one was held already.
+func (c *Client) replayed(pageNo string) (Page, bool, error) {
+	page, exists := c.page(pageNo)
+	if exists && (page.Access == READ || page.Access == READWRITE) {
+		return page, false, nil
+	}
+	return Page{}, true, errStaleDuplicate
+}
+
+// request sends a request to the primary Central Manager of a shard until it is served, re-sending
+// it with the same sequence number like a fault when it isn't acknowledged or confirmed. Denials
+// from the Central Manager are not retried. Failures are returned as a PageError of op on pageNo.
+func (c *Client) request(ctx context.Context, op string, pageNo string, shard int, msg Message) (Reply, error) {
+	policy := c.retryPolicy()
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		reply := c.CallRPC(msg, CENTRALMANAGER, -1, c.shardIP(shard))
+		err := replyError(reply)
+		if err == nil {
+			return reply, nil
+		}
+		if reply.Ack && reply.Err != NOT_CONFIRMED {
+			return reply, &PageError{Op: op, PgNo: pageNo, Err: err}
+		}
+		if attempt >= policy.MaxRetries {
+			return reply, &PageError{Op: op, PgNo: pageNo, Err: err}
+		}
+		warningcolor.Printf("Retrying Msg '%s' (%v), retry %d of %d\n", removeUnderscores(msg.Type), err, attempt+1, policy.MaxRetries)
+		select {
+		case <-time.After(backoff):
+		case <-c.cmChanged():
+		case <-ctx.Done():
+			return reply, &PageError{Op: op, PgNo: pageNo, Err: ErrTimeout}
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
 	}
 }
 
 // handles a CHANGE_CM message
 func (c *Client) handleChangeCentralManager(msg Message) {
-	c.CentralManagerIP = msg.Payload.ChangeCM.NewCMIP
-	syscolor.Printf("Changed CentralManagerIP to %s\n", c.CentralManagerIP)
+	shard := msg.Payload.ChangeCM.Shard
+	c.mu.Lock()
+	if shard < 0 || shard >= len(c.CentralManagerIPs) {
+		c.mu.Unlock()
+		errcolor.Printf("Client %d doesn't know shard %d\n", c.ID, shard)
+		return
+	}
+	c.CentralManagerIPs[shard] = msg.Payload.ChangeCM.NewCMIP
+	// Wake up requests waiting on the old Central Manager so they are re-sent to the new one
+	close(c.cmChange)
+	c.cmChange = make(chan struct{})
+	c.mu.Unlock()
+	syscolor.Printf("Changed CentralManagerIP of shard %d to %s\n", shard, msg.Payload.ChangeCM.NewCMIP)
+}
+
+// cmIP returns the IP of the Central Manager currently responsible for a page
+func (c *Client) cmIP(pgNo string) string {
+	return c.shardIP(shardOf(pgNo))
+}
+
+// shardIP returns the IP of the current primary Central Manager of a shard
+func (c *Client) shardIP(shard int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.CentralManagerIPs[shard]
+}
+
+// cmChanged returns a channel that is closed when the Central Manager changes
+func (c *Client) cmChanged() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cmChange
+}
+
+// Stats returns the Client's read hit and miss counters
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// nextSeq returns a new sequence number for a request
+func (c *Client) nextSeq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	return c.seq
+}
+
+// retryPolicy returns the Client's current retry policy
+func (c *Client) retryPolicy() RetryPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retry
+}
+
+// SetRetryPolicy changes how the Client re-sends requests whose page never arrives
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retry = policy
+}
+
+// page returns the Client's copy of a page
+func (c *Client) page(pageNo string) (Page, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, exists := c.PgCopySet[pageNo]
+	return page, exists
+}
+
+// invalidate sets the access of a page to NIL and reports whether the page was held
+func (c *Client) invalidate(pageNo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, exists := c.PgCopySet[pageNo]
+	if !exists {
+		return false
+	}
+	page.Access = NIL
+	c.putLocked(page)
+	return true
+}
+
+// pgCopySetCopy returns a copy of the Page Copy Set that is safe to print
+func (c *Client) pgCopySetCopy() map[string]Page {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pgCopySet := make(map[string]Page, len(c.PgCopySet))
+	for pageNo, page := range c.PgCopySet {
+		pgCopySet[pageNo] = page
+	}
+	return pgCopySet
+}
+
+// expect registers interest in the next PAGE_SEND of a page for purpose.
+// apply is the write to make to the page if it arrives for WRITE.
+func (c *Client) expect(pageNo string, purpose string, apply func(Page) Page) *pageWaiter {
+	waiter := &pageWaiter{purpose: purpose, apply: apply, arrived: make(chan arrival, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiters[pageNo] = append(c.waiters[pageNo], waiter)
+	return waiter
+}
+
+// register registers a waiter again once a PAGE_SEND took it, unless it is still registered
+func (c *Client) register(pageNo string, waiter *pageWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.waiters[pageNo], waiter) {
+		c.waiters[pageNo] = append(c.waiters[pageNo], waiter)
+	}
+}
+
+// forget removes a waiter registered with expect
+func (c *Client) forget(pageNo string, waiter *pageWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters := c.waiters[pageNo]
+	for i, w := range waiters {
+		if w == waiter {
+			c.waiters[pageNo] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[pageNo]) == 0 {
+		delete(c.waiters, pageNo)
+	}
+}
+
+// receive stores a page that arrived with PAGE_SEND and takes the waiters it satisfies.
+// The writes of WRITE waiters are made to a page received for WRITE in the order they were asked for.
+// A copy for READ older than the one held is not stored; an older page for WRITE is stored anyway
+// because the Central Manager has already handed its ownership over, but it is flagged.
+func (c *Client) receive(page Page, purpose string) (Page, []*pageWaiter, bool) {
+	page.Access = READ
+	page.Owned = false
+	page.Dirty = false
+	page.Twin = nil
+	if purpose == WRITE {
+		page.Access = READWRITE
+		page.Owned = true
+	} else {
+		page.CopySet = nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held, exists := c.PgCopySet[page.PageId]; exists && held.Version > page.Version {
+		if purpose == READ {
+			return page, nil, false
+		}
+		warningcolor.Printf("Received version %d of Page %s for WRITE but version %d was held before\n", page.Version, page.PageId, held.Version)
+	}
+	var satisfied, waiting []*pageWaiter
+	for _, waiter := range c.waiters[page.PageId] {
+		if waiter.purpose != READ && waiter.purpose != purpose {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		if waiter.apply != nil {
+			page = waiter.apply(page)
+		}
+		satisfied = append(satisfied, waiter)
+	}
+	if purpose == WRITE && page.Policy == UPDATE && len(page.CopySet) > 0 {
+		// Every write of a shared UPDATE page has to be pushed to the copies, so the
+		// owner can't write it locally
+		page.Access = READ
+	}
+	if len(waiting) == 0 {
+		delete(c.waiters, page.PageId)
+	} else {
+		c.waiters[page.PageId] = waiting
+	}
+	c.putLocked(page)
+	c.touchLocked(page.PageId)
+	c.overflowLocked()
+	return page, satisfied, true
+}
+
+// notify hands a page that has just arrived to the waiters taken by receive
+func notify(waiters []*pageWaiter, page Page, confirmed bool) {
+	for _, waiter := range waiters {
+		waiter.arrived <- arrival{page: page, confirmed: confirmed}
+	}
 }
 
 func (c *Client) seedPg() {
 	for i := 1; i <= 10; i++ {
-		c.sendWriteReq(fmt.Sprintf("P%d", i), fmt.Sprintf("Content by Client %d", c.ID))
+		c.writeAndLog(fmt.Sprintf("P%d", i), fmt.Sprintf("Content by Client %d", c.ID))
 	}
 }
 
@@ -249,22 +1115,45 @@ func (c *Client) reqGenerator() {
 		time.Sleep(1 * time.Second)
 		n := rand.Intn(2)
 		if n == 0 {
-			c.sendWriteReq(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
+			c.writeAndLog(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
 		} else {
-			c.sendReadReq(fmt.Sprintf("P%d", rand.Intn(10)))
+			c.readAndLog(fmt.Sprintf("P%d", rand.Intn(10)))
 		}
 	}
 }
 
+// readAndLog reads a page with REQUEST_TIMEOUT and prints the result
+func (c *Client) readAndLog(pageNo string) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	content, err := c.Read(ctx, pageNo)
+	if err != nil {
+		errcolor.Println(err)
+		return
+	}
+	syscolor.Printf("Page %s: %s\n", pageNo, text(content))
+}
+
+// writeAndLog writes a page with REQUEST_TIMEOUT and prints the result
+func (c *Client) writeAndLog(pageNo string, content string) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	if err := c.Write(ctx, pageNo, []byte(content)); err != nil {
+		errcolor.Println(err)
+		return
+	}
+	syscolor.Printf("Page %s written\n", pageNo)
+}
+
 // 90% read - 10% write
 // func (c *Client) reqGenerator() {
 // 	for i := 0; i < Clients; i++ {
 // 		time.Sleep(1 * time.Second)
 // 		n := rand.Intn(10)
 // 		if n == 0 {
-// 			c.sendWriteReq(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
+// 			c.writeAndLog(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
 // 		} else {
-// 			c.sendReadReq(fmt.Sprintf("P%d", rand.Intn(10)))
+// 			c.readAndLog(fmt.Sprintf("P%d", rand.Intn(10)))
 // 		}
 // 	}
 // }
@@ -275,9 +1164,9 @@ func (c *Client) reqGenerator() {
 // 		time.Sleep(1 * time.Second)
 // 		n := rand.Intn(10)
 // 		if n == 0 {
-// 			c.sendReadReq(fmt.Sprintf("P%d", rand.Intn(10)))
+// 			c.readAndLog(fmt.Sprintf("P%d", rand.Intn(10)))
 // 		} else {
-// 			c.sendWriteReq(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
+// 			c.writeAndLog(fmt.Sprintf("P%d", rand.Intn(10)), fmt.Sprintf("Content by Client %d", c.ID))
 // 		}
 // 	}
 // }
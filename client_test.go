@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// own makes c the owner of a page holding content, as if it had written it
+func own(cm *CentralManager, c *Client, pageNo string, content string) {
+	cm.setPageInfo(pageNo, PgInfo{Owner: ClientPointer{ID: c.ID, IP: c.IP}, CopySet: []ClientPointer{}})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PgCopySet[pageNo] = Page{PageId: pageNo, Content: []byte(content), Access: READWRITE}
+}
+
+func TestReadReturnsTheOwnersContent(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	own(cm, clients[0], "P1", "hello")
+	content, err := clients[1].Read(context.Background(), "P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text(content) != "hello" {
+		t.Fatalf("read %q, want %q", text(content), "hello")
+	}
+	if page, _ := clients[1].page("P1"); page.Access != READ {
+		t.Fatalf("reader holds %s access, want READ", page.Access)
+	}
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 1 || info.CopySet[0].ID != 2 {
+		t.Fatalf("CopySet %v, want the reader", info.CopySet)
+	}
+}
+
+func TestReadOfMissingPageFails(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 1)
+	_, err := clients[0].Read(context.Background(), "NOPE")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Fatalf("got %v, want ErrPageNotFound", err)
+	}
+	var pageErr *PageError
+	if !errors.As(err, &pageErr) || pageErr.Op != "read" || pageErr.PgNo != "NOPE" {
+		t.Fatalf("got %v, want a PageError of the read", err)
+	}
+}
+
+func TestReadFailsWhenTheOwnerLostThePage(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1, IP: clients[0].IP}, CopySet: []ClientPointer{}})
+	_, err := clients[1].Read(context.Background(), "P1")
+	if !errors.Is(err, ErrOwnerUnreachable) {
+		t.Fatalf("got %v, want ErrOwnerUnreachable", err)
+	}
+	if held := clients[1].pgCopySetCopy(); len(held) != 0 {
+		t.Fatalf("reader holds %v, want nothing", held)
+	}
+}
+
+func TestWriteReturnsOnceTheWriterOwnsThePage(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	for _, c := range clients {
+		if err := c.Write(ctx, "P1", []byte(fmt.Sprint("by ", c.ID))); err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := cm.pageInfo("P1"); info.Owner.ID != c.ID {
+			t.Fatalf("owner %d, want %d", info.Owner.ID, c.ID)
+		}
+		if page, _ := c.page("P1"); page.Access != READWRITE || text(page.Content) != fmt.Sprint("by ", c.ID) {
+			t.Fatalf("writer holds %q with %s access", text(page.Content), page.Access)
+		}
+	}
+	if page, _ := clients[0].page("P1"); page.Access != NIL {
+		t.Fatalf("previous owner holds %s access", page.Access)
+	}
+}
+
+func TestConcurrentWritesAreSerialized(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 5 {
+				if err := c.Write(ctx, "P1", []byte(fmt.Sprint(c.ID, ":", i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Exactly one Client ends up with write access, the one the Central Manager records
+	info, _ := cm.pageInfo("P1")
+	for _, c := range clients {
+		page, _ := c.page("P1")
+		if (page.Access == READWRITE) != (c.ID == info.Owner.ID) {
+			t.Fatalf("Client %d holds %s access, the owner is %d", c.ID, page.Access, info.Owner.ID)
+		}
+	}
+	owner, _ := clients[info.Owner.ID-1].page("P1")
+	for _, c := range clients {
+		if content, err := c.Read(ctx, "P1"); err != nil || !bytes.Equal(content, owner.Content) {
+			t.Fatalf("Client %d read %q, %v, want %q", c.ID, text(content), err, text(owner.Content))
+		}
+	}
+}
+
+// increment adds one to the decimal counter held in a page
+func increment(content []byte) {
+	n, _ := strconv.Atoi(text(content))
+	clear(content)
+	copy(content, strconv.Itoa(n+1))
+}
+
+func TestConcurrentUpdatesAreSerialized(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "C", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if err := c.Update(ctx, "C", increment); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	content, err := clients[1].Read(ctx, "C")
+	if err != nil || text(content) != "30" {
+		t.Fatalf("counter %q (%v), want 30", text(content), err)
+	}
+}
+
+func TestUnconfirmedWriteDropsThePage(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 1)
+	c := clients[0]
+	// The Central Manager is not waiting for this write any more
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 9}, CopySet: []ClientPointer{}})
+	pageSend := Message{Type: PAGE_SEND, Payload: Payload{PgSend: PgSend{Purpose: WRITE, Page: Page{PageId: "P1", Content: []byte("late")}}}}
+	c.HandlePgSend(pageSend)
+	if page, _ := c.page("P1"); page.Access != NIL {
+		t.Fatalf("Client holds %s access to a page the Central Manager didn't give it", page.Access)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 9 {
+		t.Fatalf("owner %d, want 9", info.Owner.ID)
+	}
+}
+
+func TestRequestsAreRetriedAtTheBackupAfterFailover(t *testing.T) {
+	inTempDir(t)
+	primary, primaryListener := startCM(t, true, CENTRALIZED)
+	backup, _ := startCM(t, false, CENTRALIZED)
+	if err := cmwrite([]CentralManager{*primary, *backup}); err != nil {
+		t.Fatal(err)
+	}
+	c1 := startClient(t, 1, CENTRALIZED, primary)
+	c2 := startClient(t, 2, CENTRALIZED, primary)
+	if err := clientwrite([]Client{*c1, *c2}); err != nil {
+		t.Fatal(err)
+	}
+	go backup.check()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c1.Write(ctx, "P1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	// Crash the primary once the backup has taken its metadata
+	for info, _ := backup.pageInfo("P1"); info.Owner.ID != 1; info, _ = backup.pageInfo("P1") {
+		if ctx.Err() != nil {
+			t.Fatal("backup never took the primary's metadata")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	primaryListener.Close()
+
+	if err := c2.Write(ctx, "P1", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := backup.pageInfo("P1"); info.Owner.ID != 2 {
+		t.Fatalf("backup records owner %d, want 2", info.Owner.ID)
+	}
+	content, err := c1.Read(ctx, "P1")
+	if err != nil || text(content) != "after" {
+		t.Fatalf("read %q (%v), want %q", text(content), err, "after")
+	}
+}
+
+// silentCM acknowledges every request but never sends a page
+type silentCM struct {
+	requests atomic.Int32
+}
+
+func (s *silentCM) HandleIncMsg(msg Message, reply *Reply) error {
+	s.requests.Add(1)
+	reply.Ack = true
+	return nil
+}
+
+func TestRequestGivesUpAfterMaxRetries(t *testing.T) {
+	l, ip := listen(t)
+	silent := &silentCM{}
+	serve(t, l, CENTRALMANAGER, silent)
+	c := newClient(1, "127.0.0.1:1", []string{ip})
+	c.SetRetryPolicy(RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, AttemptTimeout: 100 * time.Millisecond})
+	_, err := c.Read(context.Background(), "P1")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if n := silent.requests.Load(); n != 3 {
+		t.Fatalf("sent %d requests, want 3", n)
+	}
+}
+
+func TestValidCopyIsReadLocally(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	writer, reader := clients[0], clients[1]
+	if err := writer.Write(ctx, "P1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "v1" {
+			t.Fatalf("read %q (%v), want v1", text(content), err)
+		}
+	}
+	if stats := reader.Stats(); stats.ReadMisses != 1 || stats.ReadHits != 4 {
+		t.Fatalf("stats %+v, want 1 miss and 4 hits", stats)
+	}
+	if err := clients[2].Write(ctx, "P1", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "v2" {
+		t.Fatalf("read %q (%v) after the write, want v2", text(content), err)
+	}
+	if stats := reader.Stats(); stats.ReadMisses != 2 {
+		t.Fatalf("stats %+v, want the invalidated copy to miss", stats)
+	}
+}
+
+func TestOwnerIsDowngradedWhenItServesARead(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	owner, reader := clients[0], clients[1]
+	if err := owner.Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := owner.page("P1"); page.Access != READ {
+		t.Fatalf("owner holds %s access, want READ", page.Access)
+	}
+	// Writing again takes the page back and invalidates the reader's copy
+	if err := owner.Write(ctx, "P1", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := owner.page("P1"); page.Access != READWRITE {
+		t.Fatalf("owner holds %s access after writing", page.Access)
+	}
+	if page, _ := reader.page("P1"); page.Access != NIL {
+		t.Fatalf("reader holds %s access after the write", page.Access)
+	}
+}
+
+func TestReplayedWriteStillTakesThePage(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("orig")); err != nil {
+		t.Fatal(err)
+	}
+	// Every attempt times out at once, so the request is re-sent and the CM
+	// answers the re-sends as duplicates of the write it is already running
+	c := clients[1]
+	c.SetRetryPolicy(RetryPolicy{MaxRetries: 4, Backoff: 300 * time.Millisecond, MaxBackoff: time.Second, AttemptTimeout: time.Microsecond})
+	if err := c.Write(ctx, "P1", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := c.page("P1")
+	if got := page.Content; text(got) != "new" || page.Access != READWRITE {
+		t.Fatalf("got %q with %s access, want \"new\" with READWRITE", text(got), page.Access)
+	}
+	if got, err := clients[0].Read(ctx, "P1"); err != nil || text(got) != "new" {
+		t.Fatalf("other client read %q, %v", text(got), err)
+	}
+}
+
+func TestReplayedReadReturnsThePage(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("orig")); err != nil {
+		t.Fatal(err)
+	}
+	c := clients[1]
+	c.SetRetryPolicy(RetryPolicy{MaxRetries: 4, Backoff: 300 * time.Millisecond, MaxBackoff: time.Second, AttemptTimeout: time.Microsecond})
+	got, err := c.Read(ctx, "P1")
+	if err != nil || text(got) != "orig" {
+		t.Fatalf("got %q, %v, want \"orig\"", text(got), err)
+	}
+}
+
+func TestVersionsCountWrites(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	for _, content := range []string{"a", "b", "c"} {
+		if err := clients[0].Write(ctx, "P1", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if page, _ := clients[0].page("P1"); page.Version != 3 {
+		t.Fatalf("version %d, want 3", page.Version)
+	}
+	if _, err := clients[1].Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := clients[1].page("P1"); page.Version != 3 {
+		t.Fatalf("reader holds version %d, want 3", page.Version)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Version != 3 {
+		t.Fatalf("Central Manager tracks version %d, want 3", info.Version)
+	}
+}
+
+func TestOlderPageSendIsRefused(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	for _, content := range []string{"old", "new"} {
+		if err := clients[0].Write(ctx, "P1", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := clients[1]
+	if _, err := c.Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	stale := Page{PageId: "P1", Content: []byte("old"), Version: 1}
+	msg := Message{Type: PAGE_SEND, SenderID: 1, Payload: Payload{PgSend: PgSend{Purpose: READ, Page: stale}}}
+	if c.HandlePgSend(msg) {
+		t.Fatal("older copy accepted")
+	}
+	if page, _ := c.page("P1"); text(page.Content) != "new" || page.Version != 2 {
+		t.Fatalf("holds %q at version %d, want \"new\" at version 2", text(page.Content), page.Version)
+	}
+}
+
+// DYNAMIC mode only supports INVALIDATE pages
+func TestUpdatePolicyKeepsCopiesValid(t *testing.T) {
+	for _, mode := range []string{CENTRALIZED, IMPROVED} {
+		t.Run(mode, func(t *testing.T) {
+			_, clients := startCluster(t, mode, 3)
+			ctx := context.Background()
+			if err := clients[0].WriteWithPolicy(ctx, "CONF", []byte("v1"), UPDATE); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range clients[1:] {
+				if _, err := c.Read(ctx, "CONF"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := clients[0].Write(ctx, "CONF", []byte("v2")); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range clients[1:] {
+				misses := c.Stats().ReadMisses
+				content, err := c.Read(ctx, "CONF")
+				if err != nil || text(content) != "v2" {
+					t.Fatalf("Client %d read %q, %v, want \"v2\"", c.ID, text(content), err)
+				}
+				if c.Stats().ReadMisses != misses {
+					t.Fatalf("Client %d faulted for a pushed update", c.ID)
+				}
+			}
+		})
+	}
+}
@@ -1,45 +1,158 @@
 package main
 
 import (
+	"slices"
+	"sync"
 	"time"
 )
 
-// CentralManager is a struct that represents a Central Manager node
+// CONFIRM_TIMEOUT is how long a request may hold its page before the next one is let through
+const CONFIRM_TIMEOUT = 5 * time.Second
+
+// InvalidationPolicy decides what happens to copy holders that don't confirm an invalidation.
+// Holders that are given up on lose their place in the CopySet when the write is confirmed.
+// They may still hold a READ copy, and since reads of a valid copy are served locally such a
+// holder can go on reading the old content until it drops the copy, e.g. by evicting it.
+// Set AbortOnFailure to deny the write instead.
+type InvalidationPolicy struct {
+	Timeout        time.Duration // how long to wait for INVALIDATE_CONFIRMATION
+	Retries        int           // how many more times INVALIDATE_COPY is sent to holders that didn't confirm
+	AbortOnFailure bool          // deny the write instead of going ahead without them
+}
+
+var DefaultInvalidationPolicy = InvalidationPolicy{
+	Timeout: 1 * time.Second,
+	Retries: 1,
+}
+
+// invRound collects the INVALIDATE_CONFIRMATIONs for one write on a page
+type invRound struct {
+	writeReqID int
+	pending    map[int]bool
+	confirmed  map[int]bool
+	done       chan struct{}
+}
+
+// settle records that a holder has answered, or can't be reached, and ends the round once nobody is left.
+// The caller must hold the Central Manager's lock.
+func (r *invRound) settle(holderID int, confirmed bool) {
+	if !r.pending[holderID] {
+		return
+	}
+	delete(r.pending, holderID)
+	r.confirmed[holderID] = confirmed
+	if len(r.pending) == 0 {
+		close(r.done)
+	}
+}
+
+// CentralManager is a struct that represents a Central Manager node.
+// It manages the pages whose shardOf is its Shard.
 type CentralManager struct {
 	IP        string
+	Shard     int
 	MetaData  map[string]PgInfo
 	IsPrimary bool
+	Dedup     map[string]Outcome
+	Locks     map[string]LockState
+	Barriers  map[string]BarrierState
+
+	mu        *sync.Mutex
+	mode      string
+	queue     *pageQueue
+	running   map[string]chan struct{}
+	invRounds map[string]*invRound
+	invPolicy InvalidationPolicy
+	allocs    int      // page IDs tried by ALLOC_PAGE
+	wal       *metaLog // the metadata kept on disk, nil if the Central Manager doesn't keep it
 }
 
-// PgInfo is a struct that represents the information of a page
+// PgInfo is a struct that represents the information of a page.
+// In IMPROVED mode the CopySet stays empty, the owner keeps it instead.
 type PgInfo struct {
 	Owner   ClientPointer
 	CopySet []ClientPointer
+	Version int    // latest version of the page reported in a confirmation
+	Policy  string // INVALIDATE, UPDATE or MULTIPLE, chosen when the page is created
+	Home    *Page  // the page evicted by its owner, kept by the Central Manager until a Client asks for it
+	Freed   bool   // the page was freed with FREE_PAGE; only the ID is kept so that it isn't used again
+}
+
+// newCentralManager creates a Central Manager of a shard with empty metadata
+func newCentralManager(ip string, shard int, isPrimary bool) *CentralManager {
+	return &CentralManager{
+		IP:        ip,
+		Shard:     shard,
+		MetaData:  map[string]PgInfo{},
+		IsPrimary: isPrimary,
+		Dedup:     map[string]Outcome{},
+		Locks:     map[string]LockState{},
+		Barriers:  map[string]BarrierState{},
+		mu:        &sync.Mutex{},
+		mode:      ManagerMode,
+		queue:     newPageQueue(),
+		running:   map[string]chan struct{}{},
+		invRounds: map[string]*invRound{},
+		invPolicy: DefaultInvalidationPolicy,
+	}
 }
 
 // HandleIncMsg handles incoming messages
 func (cm *CentralManager) HandleIncMsg(msg Message, reply *Reply) error {
 	reccolor.Printf("Message of Type '%s' received\n", removeUnderscores(msg.Type))
-	if cm.IsPrimary {
+	if cm.isPrimary() {
 		switch msg.Type {
 		case READ_REQUEST:
-			cm.handleReadReq(msg)
+			reply.Err, reply.Duplicate = cm.runOnce(msg, cm.handleReadReq)
 			reply.Ack = true
 		case READ_CONFIRMATION:
-			cm.handleReadConfirmation(msg)
-			reply.Ack = true
+			reply.Ack = cm.handleReadConfirmation(msg)
 		case WRITE_REQUEST:
-			cm.handleWriteReq(msg)
+			reply.Err, reply.Duplicate = cm.runOnce(msg, cm.handleWriteReq)
+			reply.Ack = true
+		case INVALIDATE_CONFIRMATION:
+			cm.handleInvConfirmation(msg)
 			reply.Ack = true
 		case WRITE_CONFIRMATION:
-			cm.handleWriteConfirmation(msg)
+			reply.Ack = cm.handleWriteConfirmation(msg)
+		case PAGE_FAULT:
+			*reply = cm.handleFault(msg)
+		case LOCK_ACQUIRE:
+			reply.Err = cm.handleLockAcquire(msg)
+			reply.Ack = true
+		case LOCK_RELEASE:
+			reply.Err = cm.handleLockRelease(msg)
+			reply.Ack = true
+		case PAGE_EVICT:
+			reply.Err = cm.handleEvict(msg)
+			reply.Ack = true
+		case DIFF:
+			reply.Err, reply.Duplicate = cm.runOnce(msg, cm.handleDiff)
+			reply.Ack = true
+		case ALLOC_PAGE:
+			reply.Page.PageId, reply.Err, reply.Duplicate = cm.runOnceWithPage(msg, cm.handleAlloc)
+			reply.Ack = true
+		case FREE_PAGE:
+			reply.Err, reply.Duplicate = cm.runOnce(msg, cm.handleFree)
+			reply.Ack = true
+		case BARRIER_ARRIVE:
+			reply.Err = cm.handleBarrierArrive(msg)
 			reply.Ack = true
 		case PULSE:
-			reply.Payload = cm.MetaData
+			// In IMPROVED mode the metadata holds only owners and versions, so the PULSE is small
+			reply.Payload = cm.metaDataCopy()
+			reply.Dedup = cm.dedupCopy()
+			reply.Locks = cm.locksCopy()
+			reply.Barriers = cm.barriersCopy()
 			reply.Ack = true
 		case RECOVERED:
+			cm.mu.Lock()
 			cm.IsPrimary = false
-			reply.Payload = cm.MetaData
+			cm.mu.Unlock()
+			reply.Payload = cm.metaDataCopy()
+			reply.Dedup = cm.dedupCopy()
+			reply.Locks = cm.locksCopy()
+			reply.Barriers = cm.barriersCopy()
 			reply.Ack = true
 			go cm.check()
 		}
@@ -48,14 +161,96 @@ func (cm *CentralManager) HandleIncMsg(msg Message, reply *Reply) error {
 	return nil
 }
 
-// Handles a READ_REQUEST message
-func (cm *CentralManager) handleReadReq(msg Message) {
+// isPrimary reports whether the Central Manager is currently the primary
+func (cm *CentralManager) isPrimary() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.IsPrimary
+}
+
+// pageInfo returns the stored information of a page
+func (cm *CentralManager) pageInfo(pgNo string) (PgInfo, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info, exists := cm.MetaData[pgNo]
+	return info, exists
+}
+
+// setPageInfo stores the information of a page
+func (cm *CentralManager) setPageInfo(pgNo string, info PgInfo) {
+	defer cm.syncLog()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.MetaData[pgNo] = info
+	cm.logLocked(pgNo, info, false)
+}
+
+// deletePageInfo removes the information of a page
+func (cm *CentralManager) deletePageInfo(pgNo string) {
+	defer cm.syncLog()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.MetaData, pgNo)
+	cm.logLocked(pgNo, PgInfo{}, true)
+}
+
+// setMetaData replaces the whole metadata, e.g. with a copy received from another Central Manager
+func (cm *CentralManager) setMetaData(metaData map[string]PgInfo) {
+	if metaData == nil {
+		metaData = map[string]PgInfo{}
+	}
+	defer cm.syncLog()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	previous := cm.MetaData
+	cm.MetaData = metaData
+	cm.logChangesLocked(previous)
+}
+
+// metaDataCopy returns a copy of the metadata that is safe to send or print
+func (cm *CentralManager) metaDataCopy() map[string]PgInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	metaData := make(map[string]PgInfo, len(cm.MetaData))
+	for pgNo, info := range cm.MetaData {
+		info.CopySet = slices.Clone(info.CopySet)
+		metaData[pgNo] = info
+	}
+	return metaData
+}
+
+// awaitConfirmation keeps the page busy until the requester confirms or CONFIRM_TIMEOUT expires.
+// It returns NOT_CONFIRMED if the confirmation never arrived.
+func (cm *CentralManager) awaitConfirmation(pgNo string, t *turn) string {
+	if !t.wait(CONFIRM_TIMEOUT) {
+		warningcolor.Printf("No confirmation from Client %d for Page %s, moving on to the next request\n", t.requester, pgNo)
+		return NOT_CONFIRMED
+	}
+	return ""
+}
+
+// Handles a READ_REQUEST message and returns the reason if it was denied
+func (cm *CentralManager) handleReadReq(msg Message) string {
 	pgNo := msg.Payload.ReadReq.PgNo
-	page, exists := cm.MetaData[pgNo]
+	if shardOf(pgNo) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", pgNo, cm.Shard)
+		return WRONG_MANAGER
+	}
+	t := cm.queue.enter(pgNo, msg.SenderID)
+	defer cm.queue.leave(pgNo, t)
+
+	page, exists := cm.pageInfo(pgNo)
 	if !exists {
 		errcolor.Printf("Central Manager doesn't have Page %s\n", pgNo)
 		errcolor.Printf("ReadReq by Client %d denied\n", msg.SenderID)
-		return
+		return PAGE_NOT_FOUND
+	}
+	if page.Freed {
+		errcolor.Printf("Page %s has been freed, ReadReq by Client %d denied\n", pgNo, msg.SenderID)
+		return PAGE_FREED
+	}
+	if page.Home != nil {
+		return cm.handOut(pgNo, page, ClientPointer{ID: msg.SenderID, IP: msg.SenderIP}, t)
 	}
 	pgOwner := page.Owner
 	readForward := Message{
@@ -72,78 +267,112 @@ func (cm *CentralManager) handleReadReq(msg Message) {
 	reply := cm.CallRPC(readForward, CLIENT, pgOwner.ID, pgOwner.IP)
 	if !reply.Ack {
 		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", pgOwner.ID, removeUnderscores(readForward.Type))
-		return
+		return OWNER_UNREACHABLE
 	}
+	return cm.awaitConfirmation(pgNo, t)
 }
 
-// Handles a READ_CONFIRMATION message
-func (cm *CentralManager) handleReadConfirmation(msg Message) {
+// Handles a READ_CONFIRMATION message and reports whether the reader was recorded. A confirmation
+// for a page that is missing or freed, or one that comes after the Central Manager moved on to the
+// next request, is ignored.
+func (cm *CentralManager) handleReadConfirmation(msg Message) bool {
 	reqPg := msg.Payload.ReadConfirm.PgNum
 	readReqID := msg.Payload.ReadConfirm.ReadReqID
 	readReqIP := msg.Payload.ReadConfirm.ReadReqIP
-	pgOwner := cm.MetaData[reqPg].Owner
-	reqPointer := ClientPointer{ID: readReqID, IP: readReqIP}
-	updatedCopySet := append(cm.MetaData[reqPg].CopySet, reqPointer)
-	cm.MetaData[reqPg] = PgInfo{Owner: pgOwner, CopySet: updatedCopySet}
-	syscolor.Println("Updated Copyset: ", updatedCopySet)
+	if !cm.queue.running(reqPg, readReqID) {
+		warningcolor.Printf("Ignoring a late read confirmation from Client %d for Page %s\n", readReqID, reqPg)
+		return false
+	}
+	defer cm.queue.complete(reqPg, readReqID)
+
+	cm.mu.Lock()
+	pgInfo, exists := cm.MetaData[reqPg]
+	if !exists || pgInfo.Freed {
+		cm.mu.Unlock()
+		warningcolor.Printf("Ignoring a read confirmation from Client %d for missing or freed Page %s\n", readReqID, reqPg)
+		return false
+	}
+	if cm.mode != IMPROVED {
+		reqPointer := ClientPointer{ID: readReqID, IP: readReqIP}
+		pgInfo.CopySet = addPointer(pgInfo.CopySet, reqPointer)
+	}
+	pgInfo.Version = max(pgInfo.Version, msg.Payload.ReadConfirm.Version)
+	cm.MetaData[reqPg] = pgInfo
+	cm.logLocked(reqPg, pgInfo, false)
+	cm.mu.Unlock()
+	cm.syncLog()
+	if cm.mode != IMPROVED {
+		syscolor.Println("Updated Copyset: ", pgInfo.CopySet)
+	}
+	return true
 }
 
-// handleWriteReq handles a WRITE_REQUEST message
-func (cm *CentralManager) handleWriteReq(msg Message) {
+// handleWriteReq handles a WRITE_REQUEST message and returns the reason if it failed
+func (cm *CentralManager) handleWriteReq(msg Message) string {
 	targetPg := msg.Payload.WriteReq.PgNo
-	content := msg.Payload.WriteReq.Content
 	writeReqID := msg.SenderID
 	writeReqIP := msg.SenderIP
 	writeReqPointer := ClientPointer{
 		ID: writeReqID,
 		IP: writeReqIP,
 	}
+	if shardOf(targetPg) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", targetPg, cm.Shard)
+		return WRONG_MANAGER
+	}
+	t := cm.queue.enter(targetPg, writeReqID)
+	defer cm.queue.leave(targetPg, t)
 
-	pgInfo, exists := cm.MetaData[targetPg]
+	pgInfo, exists := cm.pageInfo(targetPg)
 	if !exists {
 		warningcolor.Printf("Central Manager doesn't have Page %s stored\n", targetPg)
 		warningcolor.Printf("Creating and Adding Page %s into Central Manager's record\n", targetPg)
-		cm.MetaData[targetPg] = PgInfo{
+		policy := msg.Payload.WriteReq.Policy
+		if policy == "" {
+			policy = CoherencePolicy
+		}
+		pgInfo = PgInfo{
 			Owner:   writeReqPointer,
 			CopySet: []ClientPointer{},
+			Policy:  policy,
 		}
-		syscolor.Printf("PgInfo stored:%v\n", cm.MetaData[targetPg])
+		cm.setPageInfo(targetPg, pgInfo)
+		syscolor.Printf("PgInfo stored:%v\n", pgInfo)
 		pageSend := Message{
 			Type: PAGE_SEND,
 			Payload: Payload{
 				PgSend: PgSend{
 					Purpose: WRITE,
-					Page: Page{
-						PageId:  targetPg,
-						Content: content,
-					},
+					Page:    newPage(targetPg, policy),
 				},
 			},
 		}
 		reply := cm.CallRPC(pageSend, CLIENT, writeReqID, writeReqIP)
 		if !reply.Ack {
 			errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", writeReqID, removeUnderscores(PAGE_SEND))
+			// Forget the page again so a retry creates it afresh
+			cm.deletePageInfo(targetPg)
+			return NOT_CONFIRMED
 		}
-		return
+		return cm.awaitConfirmation(targetPg, t)
 	}
-	// If the page is already stored in the Central Manager
-	for _, clientPointer := range pgInfo.CopySet {
-		invalidateCopy := Message{
-			Type: INVALIDATE_COPY,
-			Payload: Payload{
-				InvCopy: InvCopy{
-					WriteReqID: writeReqID,
-					PgNum:      targetPg,
-				},
-			},
-		}
-
-		reply := cm.CallRPC(invalidateCopy, CLIENT, clientPointer.ID, clientPointer.IP)
-		if !reply.Ack {
-			errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", clientPointer.ID, removeUnderscores(invalidateCopy.Type))
-			errcolor.Println("Central Manager was unable to forward Write Request")
-			return
-		}
+	if pgInfo.Freed {
+		errcolor.Printf("Page %s has been freed, WriteReq by Client %d denied\n", targetPg, writeReqID)
+		return PAGE_FREED
+	}
+	if pgInfo.Policy == MULTIPLE {
+		// The writer sends a diff of its copy instead of taking the page
+		return MULTIPLE_WRITER
+	}
+	if pgInfo.Home != nil {
+		return cm.handOut(targetPg, pgInfo, writeReqPointer, t)
+	}
+	// If the page is already stored in the Central Manager. In IMPROVED mode the owner
+	// invalidates the copies itself before handing the page over, and copies of an UPDATE
+	// page stay valid because the writer pushes the new content to them.
+	if cm.mode != IMPROVED && pgInfo.Policy != UPDATE && !cm.invalidateCopies(targetPg, pgInfo.CopySet, writeReqID) {
+		errcolor.Println("Central Manager was unable to forward Write Request")
+		return INVALIDATION_FAILED
 	}
 
 	writeForward := Message{
@@ -153,33 +382,149 @@ func (cm *CentralManager) handleWriteReq(msg Message) {
 				WriteReqID: writeReqID,
 				WriteReqIP: writeReqIP,
 				PgNum:      targetPg,
-				Content:    content,
+				CopySet:    pgInfo.CopySet,
 			},
 		},
 	}
-	updatedPgInfo := cm.MetaData[targetPg]
-	ownerID := updatedPgInfo.Owner.ID
-	ownerIP := updatedPgInfo.Owner.IP
+	ownerID := pgInfo.Owner.ID
+	ownerIP := pgInfo.Owner.IP
 	reply := cm.CallRPC(writeForward, CLIENT, ownerID, ownerIP)
 	if !reply.Ack {
 		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", ownerID, removeUnderscores(writeForward.Type))
+		return OWNER_UNREACHABLE
+	}
+	return cm.awaitConfirmation(targetPg, t)
+}
+
+// invalidationPolicy returns the Central Manager's current invalidation policy
+func (cm *CentralManager) invalidationPolicy() InvalidationPolicy {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.invPolicy
+}
+
+// SetInvalidationPolicy changes what happens to copy holders that don't confirm an invalidation
+func (cm *CentralManager) SetInvalidationPolicy(policy InvalidationPolicy) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.invPolicy = policy
+}
+
+// invalidateCopies sends INVALIDATE_COPY to every holder of a copy at once and waits for their
+// INVALIDATE_CONFIRMATION. Holders that can't be reached or don't confirm in time are handled by
+// the Central Manager's InvalidationPolicy. It reports whether the write may go ahead.
+func (cm *CentralManager) invalidateCopies(pgNo string, copySet []ClientPointer, writeReqID int) bool {
+	policy := cm.invalidationPolicy()
+	pending := map[int]ClientPointer{}
+	for _, holder := range copySet {
+		// The requester's own copy is replaced by the page it is about to receive
+		if holder.ID != writeReqID {
+			pending[holder.ID] = holder
+		}
+	}
+
+	for retry := 0; len(pending) > 0; retry++ {
+		round := &invRound{
+			writeReqID: writeReqID,
+			pending:    map[int]bool{},
+			confirmed:  map[int]bool{},
+			done:       make(chan struct{}),
+		}
+		for id := range pending {
+			round.pending[id] = true
+		}
+		cm.mu.Lock()
+		cm.invRounds[pgNo] = round
+		cm.mu.Unlock()
+
+		for _, holder := range pending {
+			go func(holder ClientPointer) {
+				invalidateCopy := Message{
+					Type: INVALIDATE_COPY,
+					Payload: Payload{
+						InvCopy: InvCopy{
+							WriteReqID: writeReqID,
+							PgNum:      pgNo,
+						},
+					},
+				}
+				reply := cm.CallRPC(invalidateCopy, CLIENT, holder.ID, holder.IP)
+				if !reply.Ack {
+					errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", holder.ID, removeUnderscores(invalidateCopy.Type))
+					cm.mu.Lock()
+					round.settle(holder.ID, false)
+					cm.mu.Unlock()
+				}
+			}(holder)
+		}
+
+		select {
+		case <-round.done:
+		case <-time.After(policy.Timeout):
+		}
+
+		cm.mu.Lock()
+		delete(cm.invRounds, pgNo)
+		for id := range pending {
+			if round.confirmed[id] {
+				delete(pending, id)
+			}
+		}
+		cm.mu.Unlock()
+
+		if len(pending) > 0 && retry >= policy.Retries {
+			break
+		}
+	}
+
+	for _, holder := range pending {
+		warningcolor.Printf("Client %d did not confirm the invalidation of Page %s\n", holder.ID, pgNo)
+	}
+	return len(pending) == 0 || !policy.AbortOnFailure
+}
+
+// handleInvConfirmation handles an INVALIDATE_CONFIRMATION message
+func (cm *CentralManager) handleInvConfirmation(msg Message) {
+	pgNo := msg.Payload.InvConfirm.PgNum
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	round, exists := cm.invRounds[pgNo]
+	if !exists || round.writeReqID != msg.Payload.InvConfirm.WriteReqID {
 		return
 	}
+	round.settle(msg.SenderID, true)
 }
 
-// handleWriteConfirmation handles a WRITE_CONFIRMATION message
-func (cm *CentralManager) handleWriteConfirmation(msg Message) {
+// handleWriteConfirmation handles a WRITE_CONFIRMATION message and reports whether the writer was
+// recorded as the owner. A confirmation that comes after the Central Manager moved on to the next
+// request is ignored, so that it can't hand the page back to a writer that was given up on.
+func (cm *CentralManager) handleWriteConfirmation(msg Message) bool {
 	newPgNo := msg.Payload.WriteConfirm.PgNum
-	newPg, exists := cm.MetaData[newPgNo]
+	writerID := msg.Payload.WriteConfirm.WriterID
+	writerIP := msg.Payload.WriteConfirm.WriterIP
+	if !cm.queue.running(newPgNo, writerID) {
+		warningcolor.Printf("Ignoring a late write confirmation from Client %d for Page %s\n", writerID, newPgNo)
+		return false
+	}
+	defer cm.queue.complete(newPgNo, writerID)
+
+	newPg, exists := cm.pageInfo(newPgNo)
 	if !exists {
 		errcolor.Printf("Central Manager doesn't have Page %s Info stored", newPgNo)
-		return
+		return false
+	}
+	version := msg.Payload.WriteConfirm.Version
+	if version < newPg.Version {
+		warningcolor.Printf("Client %d confirmed version %d of Page %s but version %d was seen before\n", writerID, version, newPgNo, newPg.Version)
 	}
-	writerID := msg.Payload.WriteConfirm.WriterID
-	writerIP := msg.Payload.WriteConfirm.WriterIP
 	newPg.Owner = ClientPointer{ID: writerID, IP: writerIP}
 	newPg.CopySet = []ClientPointer{}
-	cm.MetaData[newPgNo] = newPg
+	if newPg.Policy == UPDATE && cm.mode != IMPROVED {
+		newPg.CopySet = append(newPg.CopySet, msg.Payload.WriteConfirm.CopySet...)
+	}
+	newPg.Version = max(newPg.Version, version)
+	cm.setPageInfo(newPgNo, newPg)
+	return true
 }
 
 // check checks if the Primary Central Manager is alive
@@ -194,7 +539,7 @@ func (cm *CentralManager) check() {
 				},
 			},
 		}
-		primaryCMIP, err := primaryCMIP()
+		primaryCMIP, err := primaryCMIP(cm.Shard)
 		if err != nil {
 			errcolor.Println("Backup Central Manager couldn't get Primary Central Manager's IP")
 			return
@@ -204,7 +549,9 @@ func (cm *CentralManager) check() {
 			errcolor.Println("PULSE not retrived from the Primary Central Manager")
 			errcolor.Println("Primary Central Manager is dead")
 			syscolor.Println("Backup Central Manager is taking over Now")
+			cm.mu.Lock()
 			cm.IsPrimary = true
+			cm.mu.Unlock()
 			syscolor.Println("Backup Central Manager is Primary Central Manager now")
 
 			clientArr := clientList()
@@ -215,6 +562,7 @@ func (cm *CentralManager) check() {
 					Payload: Payload{
 						ChangeCM: ChangeCM{
 							NewCMIP: cm.IP,
+							Shard:   cm.Shard,
 						},
 					},
 				}
@@ -226,7 +574,10 @@ func (cm *CentralManager) check() {
 			}
 			return
 		} else {
-			cm.MetaData = reply.Payload
+			cm.setMetaData(reply.Payload)
+			cm.setDedup(reply.Dedup)
+			cm.setLocks(reply.Locks)
+			cm.setBarriers(reply.Barriers)
 		}
 	}
 }
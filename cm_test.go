@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// readConfirmation returns a READ_CONFIRMATION of pgNo by reader
+func readConfirmation(pgNo string, reader int) Message {
+	return Message{
+		Type: READ_CONFIRMATION,
+		Payload: Payload{
+			ReadConfirm: ReadConfirm{
+				PgNum:     pgNo,
+				ReadReqID: reader,
+				ReadReqIP: "127.0.0.1:1",
+			},
+		},
+	}
+}
+
+// writeConfirmation returns a WRITE_CONFIRMATION of pgNo by writer
+func writeConfirmation(pgNo string, writer int) Message {
+	return Message{
+		Type: WRITE_CONFIRMATION,
+		Payload: Payload{
+			WriteConfirm: WriteConfirm{
+				PgNum:    pgNo,
+				WriterID: writer,
+				WriterIP: "127.0.0.1:1",
+			},
+		},
+	}
+}
+
+func TestReadConfirmationRecordsTheRunningReader(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1}, CopySet: []ClientPointer{}})
+	turn := cm.queue.enter("P1", 2)
+	var reply Reply
+	cm.HandleIncMsg(readConfirmation("P1", 2), &reply)
+	if !reply.Ack {
+		t.Fatal("confirmation of the running read not acknowledged")
+	}
+	if !turn.wait(time.Second) {
+		t.Fatal("read not completed")
+	}
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 1 || info.CopySet[0].ID != 2 {
+		t.Fatalf("CopySet %v, want the reader", info.CopySet)
+	}
+}
+
+func TestReadConfirmationIgnoredWhenLate(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1}, CopySet: []ClientPointer{}})
+	cm.queue.enter("P1", 3)
+	var reply Reply
+	cm.HandleIncMsg(readConfirmation("P1", 2), &reply)
+	if reply.Ack {
+		t.Fatal("confirmation of a read that isn't running acknowledged")
+	}
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 0 {
+		t.Fatalf("CopySet %v, want it empty", info.CopySet)
+	}
+}
+
+func TestReadConfirmationIgnoredForMissingPage(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	turn := cm.queue.enter("MISSING", 2)
+	var reply Reply
+	cm.HandleIncMsg(readConfirmation("MISSING", 2), &reply)
+	if reply.Ack {
+		t.Fatal("confirmation for a missing page acknowledged")
+	}
+	cm.queue.leave("MISSING", turn)
+	if _, exists := cm.pageInfo("MISSING"); exists {
+		t.Fatal("confirmation created a page")
+	}
+}
+
+func TestWriteConfirmationRecordsTheRunningWriter(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1}, CopySet: []ClientPointer{{ID: 3}}})
+	turn := cm.queue.enter("P1", 2)
+	var reply Reply
+	cm.HandleIncMsg(writeConfirmation("P1", 2), &reply)
+	if !reply.Ack {
+		t.Fatal("confirmation of the running write not acknowledged")
+	}
+	if !turn.wait(time.Second) {
+		t.Fatal("write not completed")
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 2 || len(info.CopySet) != 0 {
+		t.Fatalf("page info %+v, want Client 2 to own it without copies", info)
+	}
+}
+
+func TestWriteConfirmationIgnoredWhenLate(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1}, CopySet: []ClientPointer{{ID: 3}}})
+	// The write of Client 2 timed out and the Central Manager went on to the request of Client 3
+	cm.queue.enter("P1", 3)
+	var reply Reply
+	cm.HandleIncMsg(writeConfirmation("P1", 2), &reply)
+	if reply.Ack {
+		t.Fatal("confirmation of a write that isn't running acknowledged")
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 1 || len(info.CopySet) != 1 {
+		t.Fatalf("page info changed to %+v", info)
+	}
+}
+
+func TestWriteInvalidatesEveryCopy(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 4)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients[1:] {
+		if _, err := c.Read(ctx, "P1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clients[1].Write(ctx, "P1", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if page, _ := c.page("P1"); c != clients[1] && page.Access != NIL {
+			t.Fatalf("Client %d still holds %s access", c.ID, page.Access)
+		}
+	}
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 0 {
+		t.Fatalf("CopySet %v, want it empty", info.CopySet)
+	}
+}
+
+// addUnreachableHolder adds a copy holder that can't be reached to a page's CopySet
+func addUnreachableHolder(cm *CentralManager, pgNo string) {
+	info, _ := cm.pageInfo(pgNo)
+	info.CopySet = append(info.CopySet, ClientPointer{ID: 9, IP: "127.0.0.1:1"})
+	cm.setPageInfo(pgNo, info)
+}
+
+func TestInvalidationPolicyProceedsWithoutUnreachableHolders(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	cm.SetInvalidationPolicy(InvalidationPolicy{Timeout: 100 * time.Millisecond})
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	addUnreachableHolder(cm, "P1")
+	if err := clients[1].Write(ctx, "P1", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 2 || len(info.CopySet) != 0 {
+		t.Fatalf("page info %+v, want Client 2 to own it without copies", info)
+	}
+}
+
+func TestInvalidationPolicyCanAbortTheWrite(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	cm.SetInvalidationPolicy(InvalidationPolicy{Timeout: 100 * time.Millisecond, Retries: 1, AbortOnFailure: true})
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	addUnreachableHolder(cm, "P1")
+	if err := clients[1].Write(ctx, "P1", []byte("y")); !errors.Is(err, ErrInvalidation) {
+		t.Fatalf("got %v, want ErrInvalidation", err)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 1 {
+		t.Fatalf("owner %d, want the write denied", info.Owner.ID)
+	}
+}
+
+func TestRequestsForAnotherShardAreDenied(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", shardOf("P1")+1, true)
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1}, CopySet: []ClientPointer{}})
+	requests := []Message{
+		{Type: READ_REQUEST, SenderID: 2, Payload: Payload{ReadReq: ReadReq{PgNo: "P1"}}},
+		{Type: WRITE_REQUEST, SenderID: 2, Payload: Payload{WriteReq: WriteReq{PgNo: "P1"}}},
+	}
+	for _, msg := range requests {
+		var reply Reply
+		cm.HandleIncMsg(msg, &reply)
+		if reply.Err != WRONG_MANAGER {
+			t.Fatalf("%s got %q, want WRONG_MANAGER", msg.Type, reply.Err)
+		}
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 1 || len(info.CopySet) != 0 {
+		t.Fatalf("page info changed to %+v", info)
+	}
+}
+
+func TestVacantCMRoleFillsPrimariesFirst(t *testing.T) {
+	withManagers(t, 2)
+	var cms []CentralManager
+	for _, want := range []bool{true, false} {
+		for shard := 0; shard < Managers; shard++ {
+			gotShard, gotPrimary, ok := vacantCMRole(cms)
+			if !ok || gotShard != shard || gotPrimary != want {
+				t.Fatalf("got shard %d primary %v, want shard %d primary %v", gotShard, gotPrimary, shard, want)
+			}
+			cms = append(cms, CentralManager{Shard: shard, IsPrimary: want})
+		}
+	}
+	if _, _, ok := vacantCMRole(cms); ok {
+		t.Fatal("found a vacant role with every role taken")
+	}
+}
+
+func TestPagesAreSpreadAcrossShards(t *testing.T) {
+	withManagers(t, 2)
+	var cms []*CentralManager
+	var cmIPs []string
+	for shard := range Managers {
+		l, ip := listen(t)
+		cm := newCentralManager(ip, shard, true)
+		serve(t, l, CENTRALMANAGER, cm)
+		cms = append(cms, cm)
+		cmIPs = append(cmIPs, ip)
+	}
+	var clients []*Client
+	for id := 1; id <= 2; id++ {
+		l, ip := listen(t)
+		c := newClient(id, ip, cmIPs)
+		serve(t, l, CLIENT, c)
+		clients = append(clients, c)
+	}
+	// One page of every shard
+	pages := map[int]string{}
+	for i := 1; len(pages) < Managers; i++ {
+		pgNo := fmt.Sprint("P", i)
+		if _, exists := pages[shardOf(pgNo)]; !exists {
+			pages[shardOf(pgNo)] = pgNo
+		}
+	}
+
+	ctx := context.Background()
+	for shard, pgNo := range pages {
+		if err := clients[0].Write(ctx, pgNo, []byte(pgNo)); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := clients[1].Read(ctx, pgNo); err != nil || text(content) != pgNo {
+			t.Fatalf("read %q (%v) of Page %s, want %q", text(content), err, pgNo, pgNo)
+		}
+		for _, cm := range cms {
+			if _, exists := cm.pageInfo(pgNo); exists != (cm.Shard == shard) {
+				t.Fatalf("Central Manager of shard %d has Page %s: %v, the page is in shard %d", cm.Shard, pgNo, exists, shard)
+			}
+		}
+	}
+}
+
+func TestImprovedOwnerKeepsTheCopySet(t *testing.T) {
+	cm, clients := startCluster(t, IMPROVED, 3)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients[1:] {
+		if _, err := c.Read(ctx, "P1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if page, _ := clients[0].page("P1"); len(page.CopySet) != 2 {
+		t.Fatalf("owner's CopySet %v, want both readers", page.CopySet)
+	}
+	if info, _ := cm.pageInfo("P1"); len(info.CopySet) != 0 {
+		t.Fatalf("Central Manager's CopySet %v, want it empty", info.CopySet)
+	}
+	if err := clients[1].Write(ctx, "P1", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{clients[0], clients[2]} {
+		if page, _ := c.page("P1"); page.Access != NIL {
+			t.Fatalf("Client %d still holds %s access", c.ID, page.Access)
+		}
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 2 {
+		t.Fatalf("owner %d, want 2", info.Owner.ID)
+	}
+	if content, err := clients[2].Read(ctx, "P1"); err != nil || text(content) != "y" {
+		t.Fatalf("read %q, %v, want \"y\"", text(content), err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DEDUP_TTL is how long the Central Manager remembers the outcome of a request
+const DEDUP_TTL = 2 * time.Minute
+
+// DEDUP_SWEEP is how often the Central Manager forgets outcomes older than DEDUP_TTL
+const DEDUP_SWEEP = 30 * time.Second
+
+// Outcome is the result of a request the Central Manager has already run
+type Outcome struct {
+	Err  string
+	PgNo string // the page the request created, e.g. with ALLOC_PAGE
+	Time time.Time
+}
+
+// requestKey identifies a request by its sender and sequence number
+func requestKey(senderID int, seq uint64) string {
+	return fmt.Sprintf("%d:%d", senderID, seq)
+}
+
+// runOnce runs handle for a request unless the request was seen before. A duplicate of a
+// finished request gets the original outcome, a duplicate of a running request waits for it.
+// Requests that weren't confirmed are not remembered so that a retry runs them again.
+func (cm *CentralManager) runOnce(msg Message, handle func(Message) string) (string, bool) {
+	_, reason, duplicate := cm.runOnceWithPage(msg, func(msg Message) (string, string) {
+		return "", handle(msg)
+	})
+	return reason, duplicate
+}
+
+// runOnceWithPage is runOnce for a request that creates a page. handle returns the ID of the
+// page and the reason if it failed; a duplicate gets the ID of the page the original created.
+func (cm *CentralManager) runOnceWithPage(msg Message, handle func(Message) (string, string)) (string, string, bool) {
+	if msg.Seq == 0 {
+		pgNo, reason := handle(msg)
+		return pgNo, reason, false
+	}
+	key := requestKey(msg.SenderID, msg.Seq)
+
+	cm.mu.Lock()
+	if outcome, exists := cm.Dedup[key]; exists {
+		cm.mu.Unlock()
+		warningcolor.Printf("Duplicate Msg '%s' %s, returning the original outcome\n", removeUnderscores(msg.Type), key)
+		return outcome.PgNo, outcome.Err, true
+	}
+	if running, exists := cm.running[key]; exists {
+		cm.mu.Unlock()
+		warningcolor.Printf("Duplicate Msg '%s' %s, waiting for the original to finish\n", removeUnderscores(msg.Type), key)
+		<-running
+		return cm.runOnceWithPage(msg, handle)
+	}
+	running := make(chan struct{})
+	cm.running[key] = running
+	cm.mu.Unlock()
+
+	pgNo, reason := handle(msg)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.running, key)
+	close(running)
+	if reason != NOT_CONFIRMED {
+		cm.Dedup[key] = Outcome{Err: reason, PgNo: pgNo, Time: time.Now()}
+	}
+	return pgNo, reason, false
+}
+
+// sweepDedup forgets expired outcomes every DEDUP_SWEEP
+func (cm *CentralManager) sweepDedup() {
+	for {
+		time.Sleep(DEDUP_SWEEP)
+		cm.expireDedup(time.Now())
+	}
+}
+
+// expireDedup forgets the outcomes that are older than DEDUP_TTL at now
+func (cm *CentralManager) expireDedup(now time.Time) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for key, outcome := range cm.Dedup {
+		if now.Sub(outcome.Time) > DEDUP_TTL {
+			delete(cm.Dedup, key)
+		}
+	}
+}
+
+// setDedup replaces the dedup table, e.g. with a copy received from another Central Manager
+func (cm *CentralManager) setDedup(dedup map[string]Outcome) {
+	if dedup == nil {
+		dedup = map[string]Outcome{}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.Dedup = dedup
+}
+
+// dedupCopy returns a copy of the dedup table that is safe to send
+func (cm *CentralManager) dedupCopy() map[string]Outcome {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	dedup := make(map[string]Outcome, len(cm.Dedup))
+	for key, outcome := range cm.Dedup {
+		dedup[key] = outcome
+	}
+	return dedup
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunOnceRunsARequestOnce(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	runs := 0
+	handle := func(Message) string {
+		runs++
+		return PAGE_NOT_FOUND
+	}
+	msg := Message{Type: READ_REQUEST, SenderID: 1, Seq: 7}
+	if reason, duplicate := cm.runOnce(msg, handle); reason != PAGE_NOT_FOUND || duplicate {
+		t.Fatalf("first run returned %q, duplicate %v", reason, duplicate)
+	}
+	if reason, duplicate := cm.runOnce(msg, handle); reason != PAGE_NOT_FOUND || !duplicate {
+		t.Fatalf("duplicate returned %q, duplicate %v", reason, duplicate)
+	}
+	msg.SenderID = 2
+	cm.runOnce(msg, handle)
+	if runs != 2 {
+		t.Fatalf("handled %d times, want once per sender", runs)
+	}
+}
+
+func TestRunOnceForgetsUnconfirmedAndUnnumberedRequests(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	runs := 0
+	handle := func(Message) string {
+		runs++
+		return NOT_CONFIRMED
+	}
+	for _, seq := range []uint64{0, 0, 9, 9} {
+		if _, duplicate := cm.runOnce(Message{SenderID: 1, Seq: seq}, handle); duplicate {
+			t.Fatalf("request %d reported as a duplicate", seq)
+		}
+	}
+	if runs != 4 {
+		t.Fatalf("handled %d times, want 4", runs)
+	}
+}
+
+func TestExpireDedupForgetsOldOutcomes(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	now := time.Now()
+	cm.setDedup(map[string]Outcome{
+		requestKey(1, 1): {Time: now.Add(-DEDUP_TTL - time.Second)},
+		requestKey(1, 2): {Time: now.Add(-time.Second)},
+	})
+	cm.expireDedup(now)
+	dedup := cm.dedupCopy()
+	if _, exists := dedup[requestKey(1, 1)]; exists {
+		t.Fatal("expired outcome is still remembered")
+	}
+	if _, exists := dedup[requestKey(1, 2)]; !exists {
+		t.Fatal("recent outcome was forgotten")
+	}
+}
+
+func TestDuplicateWriteRequestIsNotRunAgain(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	first := clients[1].sendWriteReq("P1", "", 77)
+	if err := clients[0].Write(ctx, "P1", []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	again := clients[1].sendWriteReq("P1", "", 77)
+	if first.Duplicate || !again.Duplicate || again.Err != first.Err {
+		t.Fatalf("replies %+v and %+v, want the second to repeat the first", first, again)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Owner.ID != 1 {
+		t.Fatalf("owner %d, want the duplicate not to take the page", info.Owner.ID)
+	}
+}
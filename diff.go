@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// DiffRun is a run of a page's content that a write changed, starting at Offset
+type DiffRun struct {
+	Offset int
+	Data   []byte
+}
+
+// A MULTIPLE page has one owner that keeps the page, like any other, but writes don't move
+// its ownership. A writer changes its READ copy and sends the difference to the twin, the
+// content before the write, as a DIFF to the Central Manager. The Central Manager invalidates
+// the other copies and forwards the DIFF to the owner, which merges it into the page. Writers
+// of different parts of the page don't take the page from each other, and their writes are all
+// kept; writes to the same part of the page are merged in the order the DIFFs arrive.
+//
+// Outside of a lock the DIFF is sent straight away. While a Client holds a lock the twin is
+// made before the first write to the page and the DIFF is sent when the writes are written back.
+
+// makeDiff encodes the changes from twin to content, both PageSize bytes
+func makeDiff(twin []byte, content []byte) Diff {
+	var diff Diff
+	for i := 0; i < len(content); {
+		if i < len(twin) && twin[i] == content[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < len(content) && (i >= len(twin) || twin[i] != content[i]) {
+			i++
+		}
+		diff.Runs = append(diff.Runs, DiffRun{Offset: start, Data: bytes.Clone(content[start:i])})
+	}
+	return diff
+}
+
+// applyDiff returns a copy of content with a diff decoded onto it
+func applyDiff(content []byte, diff Diff) []byte {
+	merged := bytes.Clone(content)
+	for _, run := range diff.Runs {
+		if run.Offset < 0 || run.Offset+len(run.Data) > len(merged) {
+			continue
+		}
+		copy(merged[run.Offset:], run.Data)
+	}
+	return merged
+}
+
+// empty reports whether a diff changes nothing
+func (diff Diff) empty() bool {
+	return len(diff.Runs) == 0
+}
+
+// handleDiff invalidates the copies of a MULTIPLE page and has its owner merge a DIFF into it.
+// It returns the reason if it failed.
+func (cm *CentralManager) handleDiff(msg Message) string {
+	pgNo := msg.Payload.Diff.PgNo
+	if shardOf(pgNo) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", pgNo, cm.Shard)
+		return WRONG_MANAGER
+	}
+	t := cm.queue.enter(pgNo, msg.SenderID)
+	defer cm.queue.leave(pgNo, t)
+
+	info, exists := cm.pageInfo(pgNo)
+	if !exists {
+		errcolor.Printf("Central Manager doesn't have Page %s\n", pgNo)
+		return PAGE_NOT_FOUND
+	}
+	if info.Freed {
+		errcolor.Printf("Page %s has been freed, Client %d can't send a diff of it\n", pgNo, msg.SenderID)
+		return PAGE_FREED
+	}
+	if info.Policy != MULTIPLE {
+		errcolor.Printf("Page %s is a %s page, Client %d can't send a diff of it\n", pgNo, info.Policy, msg.SenderID)
+		return NOT_MULTIPLE_WRITER
+	}
+	if info.Home != nil {
+		// The owner evicted the page, so the Central Manager merges the diff into its home copy
+		if !cm.invalidateHome(pgNo, info, msg.SenderID) {
+			return INVALIDATION_FAILED
+		}
+		home := *info.Home
+		home.Content = applyDiff(home.Content, msg.Payload.Diff)
+		home.Version++
+		home.CopySet = nil
+		info.Home = &home
+		info.Version = home.Version
+		info.CopySet = []ClientPointer{}
+		cm.setPageInfo(pgNo, info)
+		syscolor.Printf("Merged Client %d's diff into the home copy of Page %s, now version %d\n", msg.SenderID, pgNo, home.Version)
+		return ""
+	}
+	// In IMPROVED mode the owner invalidates the copies itself when it merges the diff
+	if cm.mode != IMPROVED && !cm.invalidateCopies(pgNo, info.CopySet, msg.SenderID) {
+		return INVALIDATION_FAILED
+	}
+
+	diffForward := msg
+	diffForward.Type = DIFF_FORWARD
+	sendcolor.Printf("Central Manager sending Msg '%s' to Client %d\n", removeUnderscores(DIFF_FORWARD), info.Owner.ID)
+	reply := cm.CallRPC(diffForward, CLIENT, info.Owner.ID, info.Owner.IP)
+	if !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", info.Owner.ID, removeUnderscores(DIFF_FORWARD))
+		return OWNER_UNREACHABLE
+	}
+	if cm.mode != IMPROVED {
+		info, _ = cm.pageInfo(pgNo)
+		info.CopySet = []ClientPointer{}
+		cm.setPageInfo(pgNo, info)
+	}
+	return ""
+}
+
+// handleDiffForward merges a DIFF into the page this Client owns. A twin the owner has made
+// for its own buffered writes gets the DIFF too, so that only the owner's writes are in its own diff.
+// It reports whether the DIFF was merged.
+func (c *Client) handleDiffForward(msg Message) bool {
+	diff := msg.Payload.Diff
+	writer := ClientPointer{ID: msg.SenderID, IP: msg.SenderIP}
+	c.lockUnpinned(diff.PgNo)
+	page, exists := c.PgCopySet[diff.PgNo]
+	if !exists || !page.Owned {
+		c.mu.Unlock()
+		errcolor.Printf("Client %d doesn't own Page %s to merge Client %d's diff into\n", c.ID, diff.PgNo, writer.ID)
+		return false
+	}
+	page.Content = applyDiff(page.Content, diff)
+	if page.Dirty {
+		page.Twin = applyDiff(page.Twin, diff)
+	}
+	page.Version++
+	holders := page.CopySet
+	if c.mode == IMPROVED {
+		page.CopySet = nil
+	}
+	c.putLocked(page)
+	c.mu.Unlock()
+
+	if c.mode == IMPROVED {
+		c.invalidateHolders(diff.PgNo, holders, writer)
+	}
+	syscolor.Printf("Merged Client %d's diff into Page %s, now version %d\n", writer.ID, diff.PgNo, page.Version)
+	return true
+}
+
+// writeDiff makes a write to a MULTIPLE page by sending its diff to the owner
+func (c *Client) writeDiff(ctx context.Context, pageNo string, fn func(content []byte)) error {
+	c.mu.Lock()
+	page, exists := c.PgCopySet[pageNo]
+	c.mu.Unlock()
+	if !exists || page.Access == NIL {
+		var err error
+		page, err = c.fault(ctx, "write", pageNo, READ, nil, c.requester(pageNo, READ, ""))
+		if err != nil {
+			return err
+		}
+	}
+	content := bytes.Clone(page.Content)
+	fn(content)
+	return c.sendDiff(ctx, pageNo, makeDiff(page.Content, content))
+}
+
+// flushDiff writes back the buffered writes to a page as a diff against its twin.
+// A page that doesn't exist yet is created with the buffered content.
+func (c *Client) flushDiff(ctx context.Context, page Page) error {
+	diff := makeDiff(page.Twin, page.Content)
+	err := c.sendDiff(ctx, page.PageId, diff)
+	if !errors.Is(err, ErrPageNotFound) {
+		return err
+	}
+	// Somebody else may create the page first, then the diff is made to their content
+	return c.writeThrough(ctx, page.PageId, MULTIPLE, func(content []byte) {
+		copy(content, applyDiff(content, diff))
+	})
+}
+
+// sendDiff sends a DIFF of a page to the Central Manager until it has been merged.
+// The Client's own copy is invalidated afterwards, as it is missing the diffs of the other
+// writers, unless the Client is the owner.
+func (c *Client) sendDiff(ctx context.Context, pageNo string, diff Diff) error {
+	if !diff.empty() {
+		diff.PgNo = pageNo
+		diffMsg := Message{
+			Type: DIFF,
+			Payload: Payload{
+				Diff: diff,
+			},
+			SenderID: c.ID,
+			SenderIP: c.IP,
+			Seq:      c.nextSeq(),
+		}
+		if _, err := c.request(ctx, "write", pageNo, shardOf(pageNo), diffMsg); err != nil {
+			return err
+		}
+		syscolor.Printf("Diff of Page %s merged\n", pageNo)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, exists := c.PgCopySet[pageNo]
+	if !exists {
+		return nil
+	}
+	page.Dirty = false
+	page.Twin = nil
+	if !page.Owned && !diff.empty() {
+		page.Access = NIL
+	}
+	c.putLocked(page)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDiffCarriesOnlyTheChangedRuns(t *testing.T) {
+	twin := make([]byte, PageSize)
+	content := bytes.Clone(twin)
+	copy(content[2:], "ab")
+	content[PageSize-1] = 0xff
+	diff := makeDiff(twin, content)
+	if len(diff.Runs) != 2 || diff.Runs[0].Offset != 2 || string(diff.Runs[0].Data) != "ab" || diff.Runs[1].Offset != PageSize-1 {
+		t.Fatalf("diff %+v, want runs at 2 and %d", diff.Runs, PageSize-1)
+	}
+	if merged := applyDiff(twin, diff); !bytes.Equal(merged, content) {
+		t.Fatal("applying the diff to the twin doesn't give the content")
+	}
+	if twin[2] != 0 {
+		t.Fatal("applyDiff changed the content it was given")
+	}
+	if !makeDiff(content, content).empty() {
+		t.Fatal("diff of unchanged content isn't empty")
+	}
+}
+
+func TestMultipleWritersKeepEachOthersWrites(t *testing.T) {
+	for _, mode := range []string{CENTRALIZED, IMPROVED} {
+		t.Run(mode, func(t *testing.T) {
+			cm, clients := startCluster(t, mode, 3)
+			ctx := context.Background()
+			if err := clients[0].WriteWithPolicy(ctx, "M", []byte("0000000000"), MULTIPLE); err != nil {
+				t.Fatal(err)
+			}
+			// Every Client writes its own part of the page, first straight away and then under a lock of its own
+			rounds := []struct {
+				letters string
+				locked  bool
+				want    string
+			}{
+				{"abc", false, "aaabbbccc0"},
+				{"ABC", true, "AAABBBCCC0"},
+			}
+			for _, round := range rounds {
+				var wg sync.WaitGroup
+				for i, c := range clients {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						name := fmt.Sprint("L", i)
+						if round.locked {
+							if err := c.Acquire(ctx, name); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+						for k := range 3 {
+							err := c.Update(ctx, "M", func(content []byte) {
+								content[i*3+k] = round.letters[i]
+							})
+							if err != nil {
+								t.Error(err)
+							}
+						}
+						if round.locked {
+							if err := c.Release(ctx, name); err != nil {
+								t.Error(err)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				for _, c := range clients {
+					if content, err := c.Read(ctx, "M"); err != nil || text(content) != round.want {
+						t.Fatalf("Client %d read %q, %v, want %q", c.ID, text(content), err, round.want)
+					}
+				}
+			}
+			if info, _ := cm.pageInfo("M"); info.Owner.ID != 1 {
+				t.Fatalf("owner moved to %d", info.Owner.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import "time"
+
+// MAX_FAULT_HOPS bounds how many times a fault is forwarded before it is given up on
+const MAX_FAULT_HOPS = 16
+
+// FAULT_QUEUE_TIMEOUT is how long a fault waits for a Client busy with the same page
+const FAULT_QUEUE_TIMEOUT = 2 * time.Second
+
+// In DYNAMIC mode there is no manager on the data path. Every Client keeps a probable owner
+// for each page and sends its faults there; a Client that doesn't own the page passes the
+// fault on to its own probable owner until it reaches the owner, which serves it and keeps
+// the page's CopySet. The Central Manager of the page's shard only creates pages; it sends
+// later faults to the page's creator and is the probable owner of last resort.
+
+// sendFault faults a page in. The Client keeps its own turn on the page until the fault is
+// served, so faults of other Clients that reach it in the meantime wait for it to become the owner.
+func (c *Client) sendFault(pageNo string, purpose string, seq uint64) Reply {
+	fault := Message{
+		Type: PAGE_FAULT,
+		Payload: Payload{
+			Fault: Fault{
+				PgNo:    pageNo,
+				Purpose: purpose,
+				ReqID:   c.ID,
+				ReqIP:   c.IP,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+		Seq:      seq,
+	}
+	t, entered := c.queue.enterWithin(pageNo, c.ID, FAULT_QUEUE_TIMEOUT)
+	if !entered {
+		return Reply{Ack: true, Err: NOT_CONFIRMED}
+	}
+	defer c.queue.leave(pageNo, t)
+	var reply Reply
+	if c.owns(pageNo) {
+		reply = c.serveFault(fault.Payload.Fault)
+	} else {
+		reply = c.forwardFault(fault)
+	}
+	if !reply.Ack {
+		errcolor.Printf("Client %d's Msg '%s' for Page %s was not acknowledged\n", c.ID, removeUnderscores(PAGE_FAULT), pageNo)
+	}
+	return reply
+}
+
+// handleFault handles a PAGE_FAULT of another Client. It is served if this Client owns the page
+// and forwarded otherwise. Faults on a page are served one at a time, but the Client doesn't hold
+// the page while forwarding.
+func (c *Client) handleFault(msg Message) Reply {
+	fault := msg.Payload.Fault
+	if fault.ReqID == c.ID {
+		errcolor.Printf("Client %d's own fault on Page %s came back to it\n", c.ID, fault.PgNo)
+		return Reply{Ack: true, Err: OWNER_UNREACHABLE}
+	}
+	t, entered := c.queue.enterWithin(fault.PgNo, fault.ReqID, FAULT_QUEUE_TIMEOUT)
+	if !entered {
+		warningcolor.Printf("Client %d's fault on Page %s waited too long at Client %d\n", fault.ReqID, fault.PgNo, c.ID)
+		return Reply{Ack: true, Err: NOT_CONFIRMED}
+	}
+	if c.owns(fault.PgNo) {
+		defer c.queue.leave(fault.PgNo, t)
+		return c.serveFault(fault)
+	}
+	c.queue.leave(fault.PgNo, t)
+	return c.forwardFault(msg)
+}
+
+// serveFault sends an owned page to the requester of a fault. A reader is added to the CopySet
+// and the owner keeps the page READ only; a writer gets the page and its ownership once every
+// copy has been invalidated.
+func (c *Client) serveFault(fault Fault) Reply {
+	requester := ClientPointer{ID: fault.ReqID, IP: fault.ReqIP}
+	if requester.ID != c.ID {
+		c.lockUnpinned(fault.PgNo)
+	} else {
+		c.mu.Lock()
+	}
+	page := c.PgCopySet[fault.PgNo]
+	before := page
+	if requester.ID != c.ID {
+		if fault.Purpose == READ {
+			page.CopySet = addPointer(page.CopySet, requester)
+			if page.Access == READWRITE {
+				page.Access = READ
+				syscolor.Printf("Downgraded Page %s to %s access\n", fault.PgNo, READ)
+			}
+		} else {
+			page.Access = NIL
+			page.Owned = false
+			c.probOwner[fault.PgNo] = requester
+		}
+		c.putLocked(page)
+	}
+	c.mu.Unlock()
+
+	if fault.Purpose == WRITE {
+		c.invalidateHolders(fault.PgNo, before.CopySet, requester)
+		page.CopySet = nil
+	}
+	pageSend := Message{
+		Type: PAGE_SEND,
+		Payload: Payload{
+			PgSend: PgSend{
+				Purpose: fault.Purpose,
+				Page:    released(page),
+				Hops:    fault.Hops,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	if requester.ID == c.ID {
+		return Reply{Ack: c.HandlePgSend(pageSend)}
+	}
+	sendcolor.Printf("Client %d sending Msg '%s' to Client %d\n", c.ID, removeUnderscores(PAGE_SEND), requester.ID)
+	reply := c.CallRPC(pageSend, CLIENT, requester.ID, requester.IP)
+	if !reply.Ack {
+		errcolor.Printf("Msg '%s' from Client %d not acknowledged by Client %d\n", removeUnderscores(PAGE_SEND), c.ID, requester.ID)
+		if fault.Purpose == WRITE {
+			// The writer never got the page, so this Client is still its owner
+			c.mu.Lock()
+			before.CopySet = nil
+			c.putLocked(before)
+			delete(c.probOwner, fault.PgNo)
+			c.mu.Unlock()
+		}
+		return Reply{Ack: true, Err: NOT_CONFIRMED}
+	}
+	return Reply{Ack: true}
+}
+
+// forwardFault passes a fault on to the probable owner of the page, or to the page's Central
+// Manager if there is none. A Client that forwards a write expects the writer to be the next owner.
+func (c *Client) forwardFault(msg Message) Reply {
+	fault := msg.Payload.Fault
+	if fault.Hops >= MAX_FAULT_HOPS {
+		errcolor.Printf("Fault of Client %d on Page %s was forwarded %d times, giving up\n", fault.ReqID, fault.PgNo, fault.Hops)
+		return Reply{Ack: true, Err: OWNER_UNREACHABLE}
+	}
+	c.mu.Lock()
+	next, known := c.probOwner[fault.PgNo]
+	if fault.ReqID != c.ID {
+		c.stats.Forwards++
+		if fault.Purpose == WRITE {
+			c.probOwner[fault.PgNo] = ClientPointer{ID: fault.ReqID, IP: fault.ReqIP}
+		}
+	}
+	c.mu.Unlock()
+
+	msg.Payload.Fault.Hops++
+	msg.SenderID = c.ID
+	msg.SenderIP = c.IP
+	if known {
+		reply := c.CallRPC(msg, CLIENT, next.ID, next.IP)
+		if reply.Ack {
+			return reply
+		}
+		warningcolor.Printf("Probable owner Client %d of Page %s is unreachable, asking the Central Manager\n", next.ID, fault.PgNo)
+	}
+	return c.CallRPC(msg, CENTRALMANAGER, -1, c.cmIP(fault.PgNo))
+}
+
+// owns reports whether the Client is the owner of a page
+func (c *Client) owns(pageNo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PgCopySet[pageNo].Owned
+}
+
+// setProbOwner records where the Client last heard the owner of a page is
+func (c *Client) setProbOwner(pageNo string, owner ClientPointer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner.ID == c.ID {
+		delete(c.probOwner, pageNo)
+		return
+	}
+	c.probOwner[pageNo] = owner
+}
+
+// handleFault creates a page on its first write fault and otherwise forwards the fault to the page's creator
+func (cm *CentralManager) handleFault(msg Message) Reply {
+	fault := msg.Payload.Fault
+	if shardOf(fault.PgNo) != cm.Shard {
+		errcolor.Printf("Page %s is not managed by shard %d\n", fault.PgNo, cm.Shard)
+		return Reply{Ack: true, Err: WRONG_MANAGER}
+	}
+	if fault.Hops >= MAX_FAULT_HOPS {
+		errcolor.Printf("Fault of Client %d on Page %s was forwarded %d times, giving up\n", fault.ReqID, fault.PgNo, fault.Hops)
+		return Reply{Ack: true, Err: OWNER_UNREACHABLE}
+	}
+	requester := ClientPointer{ID: fault.ReqID, IP: fault.ReqIP}
+	t := cm.queue.enter(fault.PgNo, fault.ReqID)
+	info, exists := cm.pageInfo(fault.PgNo)
+	if !exists {
+		defer cm.queue.leave(fault.PgNo, t)
+		if fault.Purpose == READ {
+			errcolor.Printf("Central Manager doesn't have Page %s\n", fault.PgNo)
+			return Reply{Ack: true, Err: PAGE_NOT_FOUND}
+		}
+		syscolor.Printf("Creating Page %s with Client %d as its owner\n", fault.PgNo, fault.ReqID)
+		cm.setPageInfo(fault.PgNo, PgInfo{Owner: requester, CopySet: []ClientPointer{}, Policy: CoherencePolicy})
+		pageSend := Message{
+			Type: PAGE_SEND,
+			Payload: Payload{
+				PgSend: PgSend{
+					Purpose: WRITE,
+					Page:    newPage(fault.PgNo, CoherencePolicy),
+					Hops:    fault.Hops,
+				},
+			},
+		}
+		if reply := cm.CallRPC(pageSend, CLIENT, fault.ReqID, fault.ReqIP); !reply.Ack {
+			errcolor.Printf("Client %d did not acknowledge new Page %s\n", fault.ReqID, fault.PgNo)
+			cm.deletePageInfo(fault.PgNo)
+			return Reply{Ack: true, Err: NOT_CONFIRMED}
+		}
+		return Reply{Ack: true}
+	}
+	cm.queue.leave(fault.PgNo, t)
+	// The creator always knows where the page went, which a record updated on the way can't promise
+	owner := info.Owner
+	if owner.ID == fault.ReqID {
+		errcolor.Printf("Client %d created Page %s but doesn't know where it is\n", fault.ReqID, fault.PgNo)
+		return Reply{Ack: true, Err: OWNER_UNREACHABLE}
+	}
+
+	msg.Payload.Fault.Hops++
+	sendcolor.Printf("Central Manager forwarding Client %d's fault on Page %s to Client %d\n", fault.ReqID, fault.PgNo, owner.ID)
+	return cm.CallRPC(msg, CLIENT, owner.ID, owner.IP)
+}
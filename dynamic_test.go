@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestDynamicUpdatesAreSerialized(t *testing.T) {
+	_, clients := startCluster(t, DYNAMIC, 3)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "C", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if err := c.Update(ctx, "C", increment); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	content, err := clients[1].Read(ctx, "C")
+	if err != nil || text(content) != "30" {
+		t.Fatalf("counter %q (%v), want 30", text(content), err)
+	}
+}
+
+func TestDynamicWriteInvalidatesCopiesAndMovesTheOwner(t *testing.T) {
+	_, clients := startCluster(t, DYNAMIC, 3)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clients[1].Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := clients[0].page("P1"); len(page.CopySet) != 1 || page.CopySet[0].ID != 2 {
+		t.Fatalf("owner's CopySet %v, want the reader", page.CopySet)
+	}
+	if err := clients[2].Write(ctx, "P1", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients[:2] {
+		if page, _ := c.page("P1"); page.Access != NIL || page.Owned {
+			t.Fatalf("Client %d holds %s access, owned %v", c.ID, page.Access, page.Owned)
+		}
+	}
+	// The old owner's hint now leads to the writer, so its next fault finds the page at once
+	clients[0].mu.Lock()
+	hint := clients[0].probOwner["P1"]
+	clients[0].mu.Unlock()
+	if hint.ID != 3 {
+		t.Fatalf("probable owner %d, want 3", hint.ID)
+	}
+	if content, err := clients[0].Read(ctx, "P1"); err != nil || text(content) != "y" {
+		t.Fatalf("read %q, %v, want \"y\"", text(content), err)
+	}
+}
+
+func TestDynamicFaultCreatesThePageWithTheClustersPolicy(t *testing.T) {
+	cm, clients := startCluster(t, DYNAMIC, 1)
+	if err := clients[0].Write(context.Background(), "P1", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := cm.pageInfo("P1"); info.Policy != CoherencePolicy {
+		t.Fatalf("Central Manager records policy %q, want %q", info.Policy, CoherencePolicy)
+	}
+	if page, _ := clients[0].page("P1"); page.Policy != CoherencePolicy {
+		t.Fatalf("page has policy %q, want %q", page.Policy, CoherencePolicy)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+)
+
+// inTempDir runs the rest of the test in a fresh working directory, so files like
+// centralmanager.json don't leak between tests
+func inTempDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// withManagers runs the rest of the test with the pages partitioned across n shards
+func withManagers(t *testing.T, n int) {
+	t.Helper()
+	old := Managers
+	Managers = n
+	t.Cleanup(func() { Managers = old })
+}
+
+// listen returns a listener on a free local port and its address
+func listen(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, l.Addr().String()
+}
+
+// serve serves rcvr under name on l
+func serve(t *testing.T, l net.Listener, name string, rcvr any) {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName(name, rcvr); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+}
+
+// startCM starts the Central Manager of shard 0 in mode and returns it with its listener,
+// which a test closes to crash it
+func startCM(t *testing.T, primary bool, mode string) (*CentralManager, net.Listener) {
+	t.Helper()
+	l, ip := listen(t)
+	cm := newCentralManager(ip, 0, primary)
+	cm.mode = mode
+	serve(t, l, CENTRALMANAGER, cm)
+	return cm, l
+}
+
+// startClient starts a Client in mode that talks to cm
+func startClient(t *testing.T, id int, mode string, cm *CentralManager) *Client {
+	t.Helper()
+	l, ip := listen(t)
+	c := newClient(id, ip, []string{cm.IP})
+	c.mode = mode
+	serve(t, l, CLIENT, c)
+	return c
+}
+
+// startCluster starts a primary Central Manager and n Clients in mode
+func startCluster(t *testing.T, mode string, n int) (*CentralManager, []*Client) {
+	t.Helper()
+	cm, _ := startCM(t, true, mode)
+	var clients []*Client
+	for id := 1; id <= n; id++ {
+		clients = append(clients, startClient(t, id, mode, cm))
+	}
+	return cm, clients
+}
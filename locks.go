@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+)
+
+// LOCK_LEASE is how long a lock stays with a Client that stops renewing it
+const LOCK_LEASE = 10 * time.Second
+
+// LockState is the Client holding a lock and the Clients waiting for it in the order they asked
+type LockState struct {
+	Holder  ClientPointer
+	Expires time.Time // end of the holder's lease
+	Waiters []ClientPointer
+}
+
+// The Central Manager of a lock name's shard hands out named locks. A lock is granted right
+// away if it is free; otherwise the Client is queued and gets a LOCK_GRANT when its turn
+// comes. Holders renew their lease by asking again, and a lease that has run out is noticed
+// the next time anybody asks for the lock.
+//
+// Locks also give release consistency: while a Client holds a lock its writes are made to its
+// local copies and the pages are marked Dirty instead of faulting through the Central Manager.
+// At Release every dirty page is written back with an ordinary write, which invalidates or
+// updates the other copies, before the lock is handed to the next Client. Until then other
+// Clients are served the content the page had before its first buffered write, kept as its Twin.
+
+// handleLockAcquire grants, renews or queues a request for a lock. It returns LOCK_QUEUED if the
+// requester has to wait for a LOCK_GRANT.
+func (cm *CentralManager) handleLockAcquire(msg Message) string {
+	name := msg.Payload.Lock.Name
+	requester := ClientPointer{ID: msg.SenderID, IP: msg.SenderIP}
+	cm.mu.Lock()
+	lock, exists := cm.Locks[name]
+	if exists && lock.Holder.ID != requester.ID && time.Now().After(lock.Expires) {
+		cm.mu.Unlock()
+		warningcolor.Printf("Lease of Client %d on lock %s ran out\n", lock.Holder.ID, name)
+		cm.passLock(name, lock.Holder.ID)
+		cm.mu.Lock()
+		lock, exists = cm.Locks[name]
+	}
+	defer cm.mu.Unlock()
+	switch {
+	case !exists:
+		cm.Locks[name] = LockState{Holder: requester, Expires: time.Now().Add(LOCK_LEASE)}
+		syscolor.Printf("Lock %s granted to Client %d\n", name, requester.ID)
+		return ""
+	case lock.Holder.ID == requester.ID:
+		lock.Expires = time.Now().Add(LOCK_LEASE)
+		cm.Locks[name] = lock
+		return ""
+	default:
+		lock.Waiters = addPointer(lock.Waiters, requester)
+		cm.Locks[name] = lock
+		syscolor.Printf("Client %d is waiting for lock %s held by Client %d\n", requester.ID, name, lock.Holder.ID)
+		return LOCK_QUEUED
+	}
+}
+
+// handleLockRelease releases a lock held by the sender, or withdraws the sender from its waiters
+func (cm *CentralManager) handleLockRelease(msg Message) string {
+	name := msg.Payload.Lock.Name
+	cm.mu.Lock()
+	lock, exists := cm.Locks[name]
+	if exists && lock.Holder.ID != msg.SenderID && slices.ContainsFunc(lock.Waiters, func(waiter ClientPointer) bool {
+		return waiter.ID == msg.SenderID
+	}) {
+		lock.Waiters = removePointer(lock.Waiters, msg.SenderID)
+		cm.Locks[name] = lock
+		cm.mu.Unlock()
+		syscolor.Printf("Client %d stopped waiting for lock %s\n", msg.SenderID, name)
+		return ""
+	}
+	cm.mu.Unlock()
+	if !exists || lock.Holder.ID != msg.SenderID {
+		errcolor.Printf("Client %d released lock %s which it doesn't hold\n", msg.SenderID, name)
+		return NOT_LOCK_HOLDER
+	}
+	syscolor.Printf("Lock %s released by Client %d\n", name, msg.SenderID)
+	cm.passLock(name, msg.SenderID)
+	return ""
+}
+
+// passLock takes a lock away from holderID and grants it to the first waiter that answers its
+// LOCK_GRANT. The lock is removed once nobody is waiting.
+func (cm *CentralManager) passLock(name string, holderID int) {
+	for {
+		cm.mu.Lock()
+		lock, exists := cm.Locks[name]
+		if !exists || lock.Holder.ID != holderID {
+			cm.mu.Unlock()
+			return
+		}
+		if len(lock.Waiters) == 0 {
+			delete(cm.Locks, name)
+			cm.mu.Unlock()
+			return
+		}
+		next := lock.Waiters[0]
+		lock.Holder = next
+		lock.Waiters = lock.Waiters[1:]
+		lock.Expires = time.Now().Add(LOCK_LEASE)
+		cm.Locks[name] = lock
+		cm.mu.Unlock()
+
+		grant := Message{
+			Type: LOCK_GRANT,
+			Payload: Payload{
+				Lock: Lock{
+					Name: name,
+				},
+			},
+		}
+		reply := cm.CallRPC(grant, CLIENT, next.ID, next.IP)
+		if reply.Ack {
+			syscolor.Printf("Lock %s granted to Client %d\n", name, next.ID)
+			return
+		}
+		warningcolor.Printf("Client %d is no longer waiting for lock %s\n", next.ID, name)
+		holderID = next.ID
+	}
+}
+
+// setLocks replaces the lock table, e.g. with a copy received from another Central Manager
+func (cm *CentralManager) setLocks(locks map[string]LockState) {
+	if locks == nil {
+		locks = map[string]LockState{}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.Locks = locks
+}
+
+// locksCopy returns a copy of the lock table that is safe to send or print
+func (cm *CentralManager) locksCopy() map[string]LockState {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	locks := make(map[string]LockState, len(cm.Locks))
+	for name, lock := range cm.Locks {
+		lock.Waiters = append([]ClientPointer{}, lock.Waiters...)
+		locks[name] = lock
+	}
+	return locks
+}
+
+// Acquire takes a lock and starts buffering the Client's writes until it is released.
+// Locks don't guard particular pages: while the Client holds any lock, its writes to every page
+// are buffered, and releasing any of its locks writes them all back. It waits for the lock
+// until ctx is done, asking again every attempt timeout in case a LOCK_GRANT was lost or the
+// holder's lease ran out. The lease is renewed until Release.
+func (c *Client) Acquire(ctx context.Context, name string) error {
+	granted := make(chan struct{}, 1)
+	c.mu.Lock()
+	c.grants[name] = granted
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.grants, name)
+		c.mu.Unlock()
+	}()
+
+	for {
+		reply := c.sendLockMsg(LOCK_ACQUIRE, name)
+		if reply.Ack && reply.Err == "" {
+			break
+		}
+		if reply.Ack && reply.Err != LOCK_QUEUED {
+			return &PageError{Op: "acquire", PgNo: name, Err: replyError(reply)}
+		}
+		if c.awaitGrant(ctx, granted) {
+			break
+		}
+		if ctx.Err() != nil {
+			// Stop waiting, or give the lock back if it was granted in the meantime
+			c.sendLockMsg(LOCK_RELEASE, name)
+			return &PageError{Op: "acquire", PgNo: name, Err: ErrTimeout}
+		}
+	}
+
+	stop := make(chan struct{})
+	c.mu.Lock()
+	c.locks[name] = stop
+	c.mu.Unlock()
+	go c.keepLease(name, stop)
+	return nil
+}
+
+// awaitGrant waits up to an attempt timeout for a LOCK_GRANT and reports whether it arrived
+func (c *Client) awaitGrant(ctx context.Context, granted chan struct{}) bool {
+	timer := time.NewTimer(c.retryPolicy().AttemptTimeout)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// keepLease renews the lease on a lock until stop is closed
+func (c *Client) keepLease(name string, stop chan struct{}) {
+	ticker := time.NewTicker(LOCK_LEASE / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		reply := c.sendLockMsg(LOCK_ACQUIRE, name)
+		if reply.Ack && reply.Err == LOCK_QUEUED {
+			errcolor.Printf("Client %d lost its lease on lock %s\n", c.ID, name)
+			c.sendLockMsg(LOCK_RELEASE, name)
+			return
+		}
+	}
+}
+
+// handleLockGrant hands a LOCK_GRANT to the Acquire waiting for it. It reports
+// whether anybody was waiting, so that the Central Manager can pass the lock on otherwise.
+func (c *Client) handleLockGrant(msg Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	granted, waiting := c.grants[msg.Payload.Lock.Name]
+	if !waiting {
+		return false
+	}
+	select {
+	case granted <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Release writes back every dirty page and then releases the lock. If a page can't be written
+// back the lock is kept and the error returned, so that Release can be called again.
+func (c *Client) Release(ctx context.Context, name string) error {
+	c.mu.Lock()
+	stop, held := c.locks[name]
+	c.mu.Unlock()
+	if !held {
+		return &PageError{Op: "release", PgNo: name, Err: ErrNotLockHolder}
+	}
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.locks, name)
+	c.mu.Unlock()
+	close(stop)
+	reply := c.sendLockMsg(LOCK_RELEASE, name)
+	if err := replyError(reply); err != nil {
+		return &PageError{Op: "release", PgNo: name, Err: err}
+	}
+	return nil
+}
+
+// sends a LOCK_ACQUIRE or LOCK_RELEASE message for a lock
+func (c *Client) sendLockMsg(msgType string, name string) Reply {
+	lockMsg := Message{
+		Type: msgType,
+		Payload: Payload{
+			Lock: Lock{
+				Name: name,
+			},
+		},
+		SenderID: c.ID,
+		SenderIP: c.IP,
+	}
+	reply := c.CallRPC(lockMsg, CENTRALMANAGER, -1, c.cmIP(name))
+	if !reply.Ack {
+		errcolor.Printf("Central Manager did not acknowledge Client %d's Msg '%s'\n", c.ID, removeUnderscores(msgType))
+	}
+	return reply
+}
+
+// inSection reports whether the Client holds a lock, so that its writes are buffered
+func (c *Client) inSection() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.locks) > 0
+}
+
+// bufferWrite makes a write to the Client's copy of a page and marks it Dirty.
+// A page without a copy is read first so that fn sees its content; a page that doesn't exist
+// yet is created with policy when it is written back.
+func (c *Client) bufferWrite(ctx context.Context, pageNo string, policy string, fn func(content []byte)) error {
+	c.mu.Lock()
+	page, exists := c.PgCopySet[pageNo]
+	c.mu.Unlock()
+	if !exists || (!page.Dirty && page.Access == NIL) {
+		_, err := c.fault(ctx, "read", pageNo, READ, nil, c.requester(pageNo, READ, ""))
+		if err != nil && !errors.Is(err, ErrPageNotFound) {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page, exists = c.PgCopySet[pageNo]
+	if !exists {
+		page = newPage(pageNo, policy)
+		page.Access = NIL
+	}
+	if !page.Dirty {
+		page.Twin = page.Content
+	}
+	page.Content = bytes.Clone(page.Content)
+	fn(page.Content)
+	page.Dirty = true
+	c.putLocked(page)
+	c.touchLocked(pageNo)
+	c.overflowLocked()
+	syscolor.Printf("Buffered write to Page %s until release\n", pageNo)
+	return nil
+}
+
+// released returns a page as it was before its buffered writes, which is what other Clients
+// may see until the lock is released
+func released(page Page) Page {
+	if page.Dirty {
+		page.Content = page.Twin
+		page.Dirty = false
+	}
+	page.Twin = nil
+	return page
+}
+
+// flush writes back every dirty page, in page order. MULTIPLE pages are written back as diffs.
+func (c *Client) flush(ctx context.Context) error {
+	c.mu.Lock()
+	dirty := map[string]Page{}
+	for pageNo, page := range c.PgCopySet {
+		if page.Dirty {
+			dirty[pageNo] = page
+		}
+	}
+	c.mu.Unlock()
+
+	for _, pageNo := range slices.Sorted(maps.Keys(dirty)) {
+		if err := c.writeBack(ctx, dirty[pageNo]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBack writes back the buffered writes to a dirty page
+func (c *Client) writeBack(ctx context.Context, page Page) error {
+	if page.Policy == MULTIPLE {
+		return c.flushDiff(ctx, page)
+	}
+	err := c.writeThrough(ctx, page.PageId, page.Policy, func(content []byte) {
+		copy(content, page.Content)
+	})
+	if errors.Is(err, errMultipleWriter) {
+		// The page was created as a MULTIPLE page by another Client in the meantime
+		err = c.flushDiff(ctx, page)
+	}
+	return err
+}
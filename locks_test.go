@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWritesInASectionAreVisibleAfterRelease(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	writer, reader := clients[0], clients[1]
+	if err := writer.Write(ctx, "P1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(ctx, "P1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Acquire(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(ctx, "P1", []byte("inside")); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := writer.page("P1"); !page.Dirty || text(page.Content) != "inside" {
+		t.Fatalf("writer holds %q, dirty %v, want the buffered write", text(page.Content), page.Dirty)
+	}
+	if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "before" {
+		t.Fatalf("read %q, %v before the release, want \"before\"", text(content), err)
+	}
+	if err := writer.Release(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := writer.page("P1"); page.Dirty {
+		t.Fatal("page still dirty after the release")
+	}
+	if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "inside" {
+		t.Fatalf("read %q, %v after the release, want \"inside\"", text(content), err)
+	}
+}
+
+func TestCountersUnderALockAddUp(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	for _, pageNo := range []string{"A", "B"} {
+		if err := clients[0].Write(ctx, pageNo, []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				if err := c.Acquire(ctx, "L"); err != nil {
+					t.Error(err)
+					return
+				}
+				// Both pages are only written back at the release
+				for range 2 {
+					if err := c.Update(ctx, "B", increment); err != nil {
+						t.Error(err)
+					}
+				}
+				if err := c.Update(ctx, "A", increment); err != nil {
+					t.Error(err)
+				}
+				if err := c.Release(ctx, "L"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for pageNo, want := range map[string]string{"A": "15", "B": "30"} {
+		if content, err := clients[1].Read(ctx, pageNo); err != nil || text(content) != want {
+			t.Fatalf("counter %s is %q (%v), want %s", pageNo, text(content), err, want)
+		}
+	}
+}
+
+func TestFaultDuringASectionGetsTheReleasedContent(t *testing.T) {
+	for _, mode := range []string{CENTRALIZED, DYNAMIC} {
+		t.Run(mode, func(t *testing.T) {
+			_, clients := startCluster(t, mode, 2)
+			ctx := context.Background()
+			writer, reader := clients[0], clients[1]
+			if err := writer.Write(ctx, "P1", []byte("before")); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Acquire(ctx, "L"); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Write(ctx, "P1", []byte("inside")); err != nil {
+				t.Fatal(err)
+			}
+			// The reader has no copy, so the owner serves the fault while its write is buffered
+			content, err := reader.Read(ctx, "P1")
+			if err != nil || text(content) != "before" {
+				t.Fatalf("read %q, %v before the release, want \"before\"", text(content), err)
+			}
+			if page, _ := reader.page("P1"); page.Dirty || page.Twin != nil {
+				t.Fatalf("reader got a dirty copy %+v", page)
+			}
+			if err := writer.Release(ctx, "L"); err != nil {
+				t.Fatal(err)
+			}
+			if content, err := reader.Read(ctx, "P1"); err != nil || text(content) != "inside" {
+				t.Fatalf("read %q, %v after the release, want \"inside\"", text(content), err)
+			}
+		})
+	}
+}
+
+func TestLockIsHeldByOneClientAtATime(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 3)
+	ctx := context.Background()
+	var mu sync.Mutex
+	holders, most := 0, 0
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				if err := c.Acquire(ctx, "L"); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				holders++
+				most = max(most, holders)
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				holders--
+				mu.Unlock()
+				if err := c.Release(ctx, "L"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Fatalf("%d Clients held the lock at once", most)
+	}
+}
+
+func TestAcquireGivesUpWhenTheContextIsDone(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Acquire(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err := clients[1].Acquire(timeout, "L"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	cm.mu.Lock()
+	lock := cm.Locks["L"]
+	cm.mu.Unlock()
+	if lock.Holder.ID != 1 || len(lock.Waiters) != 0 {
+		t.Fatalf("lock %+v, want Client 1 holding it and nobody waiting", lock)
+	}
+}
+
+func TestReleaseOfALockNotHeldFails(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Release(ctx, "L"); !errors.Is(err, ErrNotLockHolder) {
+		t.Fatalf("got %v, want ErrNotLockHolder", err)
+	}
+	if err := clients[0].Acquire(ctx, "L"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := clients[1].sendLockMsg(LOCK_RELEASE, "L"); reply.Err != NOT_LOCK_HOLDER {
+		t.Fatalf("got %q, want NOT_LOCK_HOLDER", reply.Err)
+	}
+}
+
+func TestLockWithAnExpiredLeaseIsGrantedAgain(t *testing.T) {
+	cm := newCentralManager("127.0.0.1:0", 0, true)
+	cm.Locks["L"] = LockState{Holder: ClientPointer{ID: 1}, Expires: time.Now().Add(-time.Second)}
+	acquire := Message{Type: LOCK_ACQUIRE, SenderID: 2, Payload: Payload{Lock: Lock{Name: "L"}}}
+	if reason := cm.handleLockAcquire(acquire); reason != "" {
+		t.Fatalf("got %q, want the lock granted", reason)
+	}
+	if holder := cm.Locks["L"].Holder.ID; holder != 2 {
+		t.Fatalf("held by Client %d, want 2", holder)
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
+	"maps"
 	"net"
 	"net/rpc"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +23,33 @@ const (
 	Clients    = 1
 )
 
+// Managers is the number of shards the pages are partitioned across, each with its own Central
+// Manager. It is set with -managers and has to be the same on every node.
+var Managers = 1
+
+// Modes a cluster can run in
+const (
+	CENTRALIZED = "CENTRALIZED" // the Central Manager tracks every page's owner and copies and is on the path of every fault
+	DYNAMIC     = "DYNAMIC"     // faults follow probable owners from Client to Client, the Central Manager only creates pages
+	IMPROVED    = "IMPROVED"    // the Central Manager tracks only owners, each owner keeps its page's copies and invalidates them
+)
+
+// ManagerMode is the mode every node of the cluster runs in
+const ManagerMode = CENTRALIZED
+
+// CacheCapacity is how many pages a Client keeps before evicting the least recently used, 0 for no limit
+const CacheCapacity = 0
+
+// PageStore is whether every Client keeps the pages it owns on disk, so that it can be restarted with the same ID
+const PageStore = false
+
+// PageSize is the number of bytes in a page of the shared address space
+const PageSize = 4 * 1024
+
+// CoherencePolicy is the policy of pages created without choosing one, INVALIDATE, UPDATE or MULTIPLE.
+// DYNAMIC mode only supports INVALIDATE.
+const CoherencePolicy = INVALIDATE
+
 var syscolor = color.New(color.FgCyan).Add(color.BgBlack)
 var errcolor = color.New(color.FgHiRed).Add(color.BgBlack)
 var warningcolor = color.New(color.FgYellow).Add(color.BgBlack)
@@ -27,6 +58,13 @@ var sendcolor = color.New(color.FgHiBlue).Add(color.BgBlack)
 
 // main function
 func main() {
+	flag.IntVar(&Managers, "managers", Managers, "number of shards the pages are partitioned across, the same on every node")
+	flag.Parse()
+	if Managers < 1 {
+		errcolor.Println("The number of shards has to be at least 1")
+		return
+	}
+
 	ipAddress := GetOutboundIP().String()
 	port, err := GetFreePort()
 	if err != nil {
@@ -47,6 +85,7 @@ func main() {
 		syscolor.Println("2. Type 2 and Hit ENTER for Client")
 		syscolor.Println("3. Type 3 and Hit ENTER to Restart Primary Central Manager")
 		syscolor.Println("4. Type 4 and Hit ENTER to Restart Backup Central Manager")
+		syscolor.Println("5. Type 5 and Hit ENTER to Restart a Client")
 		syscolor.Print("\nEnter your choice: ")
 
 		nodeType, err = reader.ReadString('\n')
@@ -64,83 +103,104 @@ func main() {
 			StartClient(ipPlusPort)
 			return
 		case "3":
-			RestartPrimaryCM()
-			return
+			if shard, ok := readShard(reader); ok {
+				RestartPrimaryCM(shard)
+				return
+			}
 		case "4":
-			RestartBackupCM()
-			return
+			if shard, ok := readShard(reader); ok {
+				RestartBackupCM(shard)
+				return
+			}
+		case "5":
+			if id, ok := readClientID(reader); ok {
+				RestartClient(id)
+				return
+			}
 		default:
 			errcolor.Println("Invalid choice. Please try again.")
 		}
 	}
 }
 
-// StartCM starts the Central Manager
+// StartCM starts a Central Manager in the first vacant role: the primary of a shard that has
+// none yet, otherwise the backup of a shard that has none yet
 func StartCM(IpAddress string) {
-	if _, err := os.Stat(CMPATH); os.IsNotExist(err) {
-		cm := CentralManager{
-			IP:        IpAddress,
-			MetaData:  map[string]PgInfo{},
-			IsPrimary: true,
-		}
-
-		if err := cmwrite([]CentralManager{cm}); err != nil {
-			errcolor.Println("Could not write new Central Manager to file: ", err)
-			return
-		}
-		syscolor.Println("Created Central Manager and set as primary: ", cm)
-
-		// Display Central Manager commands
-		syscolor.Println("\n--- Available Central Manager Commands ---")
-		syscolor.Println("1. data     : Display the current metadata")
-		syscolor.Println("   Example: data")
-		syscolor.Println("--------------------------------------------\n")
-
-		RunCM(cm)
-
-	} else {
+	var currCM []CentralManager
+	if _, err := os.Stat(CMPATH); err == nil {
 		fileContent, err := os.ReadFile(CMPATH)
 		if err != nil {
 			errcolor.Println("Could not read from Central Manager's path: ", err)
 			return
 		}
-		var currCM []CentralManager
 		if err := json.Unmarshal(fileContent, &currCM); err != nil {
 			errcolor.Println(err)
 			return
 		}
-		backupCM := CentralManager{
-			IP:        IpAddress,
-			IsPrimary: false,
-		}
-		currCM = append(currCM, backupCM)
-		if err := cmwrite(currCM); err != nil {
-			errcolor.Println("Could not write to Central Manager's path: ", err)
-			return
-		}
-		syscolor.Println("Created Backup Central Manager: ", backupCM)
+	}
+	shard, isPrimary, ok := vacantCMRole(currCM)
+	if !ok {
+		errcolor.Printf("Every one of the %d shards already has a primary and a backup Central Manager\n", Managers)
+		return
+	}
+	cm := newCentralManager(IpAddress, shard, isPrimary)
+	if err := cm.persist(false); err != nil {
+		errcolor.Println("Could not keep the metadata on disk: ", err)
+		return
+	}
+	currCM = append(currCM, *cm)
+	if err := cmwrite(currCM); err != nil {
+		errcolor.Println("Could not write to Central Manager's path: ", err)
+		return
+	}
+	if isPrimary {
+		syscolor.Printf("Created Central Manager and set as primary of shard %d: %v\n", shard, *cm)
+	} else {
+		syscolor.Printf("Created Backup Central Manager of shard %d: %v\n", shard, *cm)
+	}
+
+	// Display Central Manager commands
+	syscolor.Println("\n--- Available Central Manager Commands ---")
+	syscolor.Println("1. data     : Display the current metadata")
+	syscolor.Println("   Example: data")
+	syscolor.Println("2. invpolicy: Display or set the invalidation policy")
+	syscolor.Println("   Example: invpolicy 1000 1 abort (timeout ms, retries, abort or proceed)")
+	syscolor.Println("--------------------------------------------")
+	syscolor.Println()
 
-		// Display Central Manager commands
-		syscolor.Println("\n--- Available Central Manager Commands ---")
-		syscolor.Println("1. data     : Display the current metadata")
-		syscolor.Println("   Example: data")
-		syscolor.Println("--------------------------------------------\n")
+	RunCM(cm)
+}
 
-		RunCM(backupCM)
+// readShard asks which shard to restart when there is more than one
+func readShard(reader *bufio.Reader) (int, bool) {
+	if Managers == 1 {
+		return 0, true
+	}
+	syscolor.Printf("Enter the shard (0-%d): ", Managers-1)
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		errcolor.Println("Error reading input: ", err)
+		return 0, false
 	}
+	shard, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil || shard < 0 || shard >= Managers {
+		errcolor.Println("Invalid shard: ", strings.TrimSpace(input))
+		return 0, false
+	}
+	return shard, true
 }
 
-// RestartPrimaryCM restarts the primary Central Manager
-func RestartPrimaryCM() {
-	primaryCMIP, err := primaryCMIP()
+// RestartPrimaryCM restarts the primary Central Manager of a shard
+func RestartPrimaryCM(shard int) {
+	primaryCMIP, err := primaryCMIP(shard)
 	if err != nil {
 		errcolor.Println("Couldn't get primary Central Manager IP: ", err)
 		return
 	}
-	restartedCM := CentralManager{
-		IP:        primaryCMIP,
-		IsPrimary: true,
-		MetaData:  map[string]PgInfo{},
+	restartedCM := newCentralManager(primaryCMIP, shard, true)
+	if err := restartedCM.persist(true); err != nil {
+		errcolor.Println("Could not rebuild the metadata from disk: ", err)
+		return
 	}
 	allCMs := cmList()
 	imBack := Message{
@@ -153,10 +213,16 @@ func RestartPrimaryCM() {
 	}
 
 	for _, cm := range allCMs {
+		if cm.Shard != shard || cm.IP == restartedCM.IP {
+			continue
+		}
 		reply := restartedCM.CallRPC(imBack, CENTRALMANAGER, -1, cm.IP)
 		if reply.Ack {
-			syscolor.Printf("Primary Central Manager with IP: %s is back and taking over\n", restartedCM.IP)
-			restartedCM.MetaData = reply.Payload
+			syscolor.Printf("Primary Central Manager of shard %d with IP: %s is back and taking over\n", shard, restartedCM.IP)
+			restartedCM.setMetaData(reply.Payload)
+			restartedCM.setDedup(reply.Dedup)
+			restartedCM.setLocks(reply.Locks)
+			restartedCM.setBarriers(reply.Barriers)
 			syscolor.Println("Data has been restored")
 			allClients := clientList()
 			for _, client := range allClients {
@@ -165,6 +231,7 @@ func RestartPrimaryCM() {
 					Payload: Payload{
 						ChangeCM: ChangeCM{
 							NewCMIP: restartedCM.IP,
+							Shard:   shard,
 						},
 					},
 				}
@@ -176,52 +243,44 @@ func RestartPrimaryCM() {
 	RunCM(restartedCM)
 }
 
-// RestartBackupCM restarts the backup Central Manager
-func RestartBackupCM() {
-	backupCMIP, err := backCMIP()
+// RestartBackupCM restarts the backup Central Manager of a shard
+func RestartBackupCM(shard int) {
+	backupCMIP, err := backCMIP(shard)
 	if err != nil {
 		errcolor.Println("Couldn't get backup Central Manager's IP: ", err)
 		return
 	}
-	restartedBackupCM := CentralManager{
-		IP:        backupCMIP,
-		IsPrimary: false,
-		MetaData:  map[string]PgInfo{},
+	restartedBackupCM := newCentralManager(backupCMIP, shard, false)
+	if err := restartedBackupCM.persist(true); err != nil {
+		errcolor.Println("Could not rebuild the metadata from disk: ", err)
+		return
 	}
 	RunCM(restartedBackupCM)
 }
 
 // StartClient starts the Client
 func StartClient(IpAddress string) {
-	var client Client
+	var client *Client
 	if _, err := os.Stat(CLIENTPATH); os.IsNotExist(err) {
-		cmip, err := primaryCMIP()
+		cmIPs, err := primaryCMIPs()
 		if err != nil {
-			errcolor.Println("Couldn't get primary Central Manager's IP: ", err)
+			errcolor.Println("Couldn't get primary Central Managers' IPs: ", err)
 			return
 		}
-		client = Client{
-			ID:               1,
-			IP:               IpAddress,
-			PgCopySet:        make(map[string]Page),
-			CentralManagerIP: cmip,
+		client = newClient(1, IpAddress, cmIPs)
+		if PageStore {
+			if err := client.usePageStore(false); err != nil {
+				errcolor.Println("Could not keep the pages on disk: ", err)
+				return
+			}
 		}
-		if err := clientwrite([]Client{client}); err != nil {
+		if err := clientwrite([]Client{*client}); err != nil {
 			errcolor.Println("Could not write to CLIENTPATH: ", err)
 			return
 		}
 		syscolor.Printf("New Client with ID %d created\n", client.ID)
 
-		// Display Client commands
-		syscolor.Println("\n--- Available Client Commands ---")
-		syscolor.Println("1. readpg   : Read a specific page")
-		syscolor.Println("   Example: readpg P1")
-		syscolor.Println("2. writepg  : Write content to a specific page")
-		syscolor.Println("   Example: writepg P1 Content1")
-		syscolor.Println("3. print    : Display the current Page Copy Set")
-		syscolor.Println("4. seed     : Seed pages")
-		syscolor.Println("5. run      : Generate 10 random r/w requests and displays the run time")
-		syscolor.Println("------------------------------\n")
+		printClientCommands()
 		RunClient(client)
 
 	} else {
@@ -236,41 +295,147 @@ func StartClient(IpAddress string) {
 		}
 		highestID := maxClientID(currClient)
 
-		cmip, err := primaryCMIP()
+		cmIPs, err := primaryCMIPs()
 		if err != nil {
-			errcolor.Println("Couldn't get primary Central Manager IP: ", err)
+			errcolor.Println("Couldn't get primary Central Managers' IPs: ", err)
 			return
 		}
-		client = Client{
-			ID:               highestID + 1,
-			IP:               IpAddress,
-			PgCopySet:        make(map[string]Page),
-			CentralManagerIP: cmip,
+		client = newClient(highestID+1, IpAddress, cmIPs)
+		if PageStore {
+			if err := client.usePageStore(false); err != nil {
+				errcolor.Println("Could not keep the pages on disk: ", err)
+				return
+			}
 		}
-		currClient = append(currClient, client)
+		currClient = append(currClient, *client)
 		if err := clientwrite(currClient); err != nil {
 			errcolor.Println("Could not write to CLIENTPATH: ", err)
 			return
 		}
 		syscolor.Printf("New Client with ID %d created\n", client.ID)
 
-		// Display Client commands
-		syscolor.Println("\n--- Available Client Commands ---")
-		syscolor.Println("1. readpg   : Read a specific page")
-		syscolor.Println("   Example: readpg P1")
-		syscolor.Println("2. writepg  : Write content to a specific page")
-		syscolor.Println("   Example: writepg P1 Content1")
-		syscolor.Println("3. print    : Display the current Page Copy Set")
-		syscolor.Println("4. seed     : Seed pages")
-		syscolor.Println("5. run      : Generate 10 random r/w requests and displays the run time")
-		syscolor.Println("------------------------------\n")
+		printClientCommands()
 
 		RunClient(client)
 	}
 }
 
+// readClientID asks which Client to restart
+func readClientID(reader *bufio.Reader) (int, bool) {
+	syscolor.Print("Enter the Client ID: ")
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		errcolor.Println("Error reading input: ", err)
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil {
+		errcolor.Println("Invalid Client ID: ", strings.TrimSpace(input))
+		return 0, false
+	}
+	return id, true
+}
+
+// RestartClient restarts a Client with its ID and IP. With PageStore it reloads the pages it
+// owned, so it can serve them again; the Central Manager still lists it as their owner.
+func RestartClient(id int) {
+	var restarted *Client
+	for _, client := range clientList() {
+		if client.ID == id {
+			restarted = newClient(id, client.IP, liveCMIPs())
+			break
+		}
+	}
+	if restarted == nil {
+		errcolor.Printf("Client %d not found in %s\n", id, CLIENTPATH)
+		return
+	}
+	if PageStore {
+		if err := restarted.usePageStore(true); err != nil {
+			errcolor.Println("Could not reload the pages from disk: ", err)
+			return
+		}
+	}
+	syscolor.Printf("Client %d restarted\n", id)
+	printClientCommands()
+	RunClient(restarted)
+}
+
+// liveCMIPs returns the Central Manager serving every shard, indexed by shard: the primary,
+// or the backup if it has taken over
+func liveCMIPs() []string {
+	cms := cmList()
+	ips := make([]string, Managers)
+	for shard := range ips {
+		ips[shard] = liveCMIP(cms, shard)
+	}
+	return ips
+}
+
+// liveCMIP returns the first Central Manager of a shard, primary first, that answers a PULSE
+// as the primary, or the primary if none does
+func liveCMIP(cms []CentralManager, shard int) string {
+	ip := ""
+	for _, primary := range []bool{true, false} {
+		for _, cm := range cms {
+			if cm.Shard != shard || cm.IsPrimary != primary {
+				continue
+			}
+			if ip == "" {
+				ip = cm.IP
+			}
+			pulse := Message{
+				Type: PULSE,
+				Payload: Payload{
+					Pulse: Pulse{
+						SenderIP: cm.IP,
+					},
+				},
+			}
+			if reply := cm.CallRPC(pulse, CENTRALMANAGER, -1, cm.IP); reply.Ack {
+				return cm.IP
+			}
+		}
+	}
+	return ip
+}
+
+// printClientCommands displays the Client commands
+func printClientCommands() {
+	syscolor.Println("\n--- Available Client Commands ---")
+	syscolor.Println("1. readpg   : Read a specific page and print its content")
+	syscolor.Println("   Example: readpg P1")
+	syscolor.Println("2. writepg  : Write content to a specific page")
+	syscolor.Println("   Example: writepg P1 Content1")
+	syscolor.Println("   Example: writepg P1 Content1 update (the policy is used if the write creates the page)")
+	syscolor.Println("3. print    : Display the current Page Copy Set")
+	syscolor.Println("4. seed     : Seed pages")
+	syscolor.Println("5. run      : Generate 10 random r/w requests and displays the run time")
+	syscolor.Println("6. retry    : Display or set the request retry policy")
+	syscolor.Println("   Example: retry 4 250 2000 (max retries, backoff ms, attempt timeout ms)")
+	syscolor.Println("7. stats    : Display how many reads were served locally and how many faulted")
+	syscolor.Println("8. lock     : Take a named lock, writes are buffered until it is unlocked")
+	syscolor.Println("   Example: lock L1")
+	syscolor.Println("9. unlock   : Write back the buffered writes and release a named lock")
+	syscolor.Println("   Example: unlock L1")
+	syscolor.Println("10. readat  : Read bytes of the shared address space")
+	syscolor.Println("   Example: readat 0x0ffc 8")
+	syscolor.Println("11. writeat : Write bytes to the shared address space")
+	syscolor.Println("   Example: writeat 0x0ffc abcdefgh")
+	syscolor.Println("12. faa     : Add to the 8 byte word at an offset in a page and print its old value")
+	syscolor.Println("   Example: faa Counter 0 1")
+	syscolor.Println("13. cas     : Set the 8 byte word at an offset in a page if it holds an expected value")
+	syscolor.Println("   Example: cas Counter 0 5 0")
+	syscolor.Println("14. alloc   : Allocate a new page and print its ID")
+	syscolor.Println("   Example: alloc update")
+	syscolor.Println("15. free    : Free a page")
+	syscolor.Println("   Example: free page3")
+	syscolor.Println("------------------------------")
+	syscolor.Println()
+}
+
 // RunCM runs the Central Manager
-func RunCM(cm CentralManager) {
+func RunCM(cm *CentralManager) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", cm.IP)
 	if err != nil {
 		errcolor.Println("Error resolving TCP address")
@@ -281,15 +446,16 @@ func RunCM(cm CentralManager) {
 		errcolor.Println("Could not listen to TCP address")
 		return
 	}
-	err = rpc.Register(&cm)
+	err = rpc.Register(cm)
 	if err != nil {
 		errcolor.Println("Error registering Central Manager's RPC methods: ", err)
 		return
 	}
-	syscolor.Printf("Central Manager's IP: %s\n", cm.IP)
+	syscolor.Printf("Central Manager's IP: %s (shard %d of %d)\n", cm.IP, cm.Shard, Managers)
 	go rpc.Accept(inbound)
+	go cm.sweepDedup()
 
-	if !cm.IsPrimary {
+	if !cm.isPrimary() {
 		go cm.check()
 	}
 	reader := bufio.NewReader(os.Stdin)
@@ -305,7 +471,7 @@ func RunCM(cm CentralManager) {
 }
 
 // RunClient runs the Client
-func RunClient(c Client) {
+func RunClient(c *Client) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", c.IP)
 	if err != nil {
 		errcolor.Println("Error resolving TCP address")
@@ -314,7 +480,7 @@ func RunClient(c Client) {
 	if err != nil {
 		errcolor.Println("Could not listen to TCP address")
 	}
-	rpc.Register(&c)
+	rpc.Register(c)
 	syscolor.Printf("Client%d's IP: %s\n", c.ID, c.IP)
 	go rpc.Accept(inbound)
 	reader := bufio.NewReader(os.Stdin)
@@ -338,7 +504,57 @@ func (cm *CentralManager) handleCMInput(input string) {
 	userinp := parts[0]
 	switch userinp {
 	case "data":
-		syscolor.Println("MetaData: ", cm.MetaData)
+		metaData := cm.metaDataCopy()
+		syscolor.Printf("MetaData of shard %d:\n", cm.Shard)
+		for _, pgNo := range slices.Sorted(maps.Keys(metaData)) {
+			info := metaData[pgNo]
+			if info.Freed {
+				syscolor.Printf("  %s (version %d, %s): freed\n", pgNo, info.Version, info.Policy)
+				continue
+			}
+			if info.Home != nil {
+				syscolor.Printf("  %s (version %d, %s): evicted, kept by the Central Manager, CopySet %v\n", pgNo, info.Version, info.Policy, info.CopySet)
+				continue
+			}
+			syscolor.Printf("  %s (version %d, %s): Owner %v, CopySet %v\n", pgNo, info.Version, info.Policy, info.Owner, info.CopySet)
+		}
+		locks := cm.locksCopy()
+		syscolor.Println("Locks:")
+		for _, name := range slices.Sorted(maps.Keys(locks)) {
+			lock := locks[name]
+			syscolor.Printf("  %s: Holder %v until %s, Waiters %v\n", name, lock.Holder, lock.Expires.Format(time.TimeOnly), lock.Waiters)
+		}
+		barriers := cm.barriersCopy()
+		syscolor.Println("Barriers:")
+		for _, name := range slices.Sorted(maps.Keys(barriers)) {
+			barrier := barriers[name]
+			syscolor.Printf("  %s: round %d, %d of %d arrived\n", name, barrier.Round, len(barrier.Arrived), barrier.N)
+		}
+	// Display or set the invalidation policy
+	case "invpolicy":
+		parameters := parts[1:]
+		if len(parameters) == 0 {
+			syscolor.Printf("Invalidation Policy: %+v\n", cm.invalidationPolicy())
+			return
+		}
+		if len(parameters) != 3 {
+			errcolor.Println("Usage: invpolicy <timeoutMs> <retries> <abort|proceed>")
+			return
+		}
+		timeoutMs, err1 := strconv.Atoi(parameters[0])
+		retries, err2 := strconv.Atoi(parameters[1])
+		onFailure := parameters[2]
+		if err1 != nil || err2 != nil || timeoutMs <= 0 || retries < 0 || (onFailure != "abort" && onFailure != "proceed") {
+			errcolor.Println("Usage: invpolicy <timeoutMs> <retries> <abort|proceed>")
+			return
+		}
+		policy := InvalidationPolicy{
+			Timeout:        time.Duration(timeoutMs) * time.Millisecond,
+			Retries:        retries,
+			AbortOnFailure: onFailure == "abort",
+		}
+		cm.SetInvalidationPolicy(policy)
+		syscolor.Printf("Invalidation Policy: %+v\n", policy)
 	default:
 		syscolor.Println("Wrong Choice")
 	}
@@ -361,30 +577,251 @@ func (c *Client) handleClientInput(input string) {
 			return
 		}
 		pageNo := parameters[0]
-		c.sendReadReq(pageNo)
+		c.readAndLog(pageNo)
 		// Write content to a specific page
 	case "writepg":
-		if len(parameters) != 2 {
-			errcolor.Println("Usage: writepg <pageNo> <content>")
+		if len(parameters) != 2 && len(parameters) != 3 {
+			errcolor.Println("Usage: writepg <pageNo> <content> [invalidate|update|multiple]")
 			return
 		}
 		pageNo := parameters[0]
 		content := parameters[1]
-		c.sendWriteReq(pageNo, content)
+		if len(parameters) == 2 {
+			c.writeAndLog(pageNo, content)
+			return
+		}
+		policy := strings.ToUpper(parameters[2])
+		if policy != INVALIDATE && policy != UPDATE && policy != MULTIPLE {
+			errcolor.Println("Usage: writepg <pageNo> <content> [invalidate|update|multiple]")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := c.WriteWithPolicy(ctx, pageNo, []byte(content), policy); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Page %s written\n", pageNo)
+		// Allocate a new page
+	case "alloc":
+		if len(parameters) > 1 {
+			errcolor.Println("Usage: alloc [invalidate|update|multiple]")
+			return
+		}
+		policy := ""
+		if len(parameters) == 1 {
+			policy = strings.ToUpper(parameters[0])
+			if policy != INVALIDATE && policy != UPDATE && policy != MULTIPLE {
+				errcolor.Println("Usage: alloc [invalidate|update|multiple]")
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		pageNo, err := c.Alloc(ctx, policy)
+		if err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Page %s allocated\n", pageNo)
+	// Free a page
+	case "free":
+		if len(parameters) != 1 {
+			errcolor.Println("Usage: free <pageNo>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := c.Free(ctx, parameters[0]); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Page %s freed\n", parameters[0])
 		// Display the current Page Copy Set
 	case "print":
-		syscolor.Println("Page Copy Set: ", c.PgCopySet)
+		pgCopySet := c.pgCopySetCopy()
+		syscolor.Println("Page Copy Set:")
+		for _, pageNo := range slices.Sorted(maps.Keys(pgCopySet)) {
+			page := pgCopySet[pageNo]
+			if page.Dirty {
+				syscolor.Printf("  %s (version %d, %s, dirty): %s\n", pageNo, page.Version, page.Access, text(page.Content))
+				continue
+			}
+			syscolor.Printf("  %s (version %d, %s): %s\n", pageNo, page.Version, page.Access, text(page.Content))
+		}
 		// Seed pages
 	case "seed":
 		c.seedPg()
-	// Generate 10 random r/w requests and displays the run time
+	// Generate 10 random r/w requests once every Client has entered run and displays the run time
 	case "run":
-		time.Sleep(60 * time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), BARRIER_TIMEOUT)
+		defer cancel()
+		syscolor.Println("Waiting for the other Clients to enter run")
+		if err := c.Barrier(ctx, "run", len(clientList())); err != nil {
+			errcolor.Println(err)
+			return
+		}
 		start := time.Now().UnixMilli()
 		c.reqGenerator()
 		end := time.Now().UnixMilli()
 		timeTaken := end - start
 		syscolor.Printf("Time Taken: %v\n", timeTaken)
+	// Take a named lock
+	case "lock":
+		if len(parameters) != 1 {
+			errcolor.Println("Usage: lock <name>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := c.Acquire(ctx, parameters[0]); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Lock %s taken\n", parameters[0])
+	// Release a named lock
+	case "unlock":
+		if len(parameters) != 1 {
+			errcolor.Println("Usage: unlock <name>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := c.Release(ctx, parameters[0]); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Lock %s released\n", parameters[0])
+	// Add to a word of a page atomically
+	case "faa":
+		if len(parameters) != 3 {
+			errcolor.Println("Usage: faa <pageNo> <offset> <delta>")
+			return
+		}
+		offset, err := strconv.Atoi(parameters[1])
+		if err != nil {
+			errcolor.Println("Usage: faa <pageNo> <offset> <delta>")
+			return
+		}
+		delta, err := strconv.ParseInt(parameters[2], 0, 64)
+		if err != nil {
+			errcolor.Println("Usage: faa <pageNo> <offset> <delta>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		fetched, err := c.FetchAndAdd(ctx, parameters[0], offset, delta)
+		if err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("Word %d of Page %s: %d -> %d\n", offset, parameters[0], fetched, fetched+delta)
+	// Swap a word of a page atomically if it holds the expected value
+	case "cas":
+		if len(parameters) != 4 {
+			errcolor.Println("Usage: cas <pageNo> <offset> <old> <new>")
+			return
+		}
+		offset, err := strconv.Atoi(parameters[1])
+		if err != nil {
+			errcolor.Println("Usage: cas <pageNo> <offset> <old> <new>")
+			return
+		}
+		old, err := strconv.ParseInt(parameters[2], 0, 64)
+		if err != nil {
+			errcolor.Println("Usage: cas <pageNo> <offset> <old> <new>")
+			return
+		}
+		replacement, err := strconv.ParseInt(parameters[3], 0, 64)
+		if err != nil {
+			errcolor.Println("Usage: cas <pageNo> <offset> <old> <new>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		swapped, err := c.CompareAndSwap(ctx, parameters[0], offset, old, replacement)
+		if err != nil {
+			errcolor.Println(err)
+			return
+		}
+		if !swapped {
+			syscolor.Printf("Word %d of Page %s is not %d, not swapped\n", offset, parameters[0], old)
+			return
+		}
+		syscolor.Printf("Word %d of Page %s swapped to %d\n", offset, parameters[0], replacement)
+	// Read bytes of the shared address space
+	case "readat":
+		if len(parameters) != 2 {
+			errcolor.Println("Usage: readat <addr> <length>")
+			return
+		}
+		addr, err := strconv.ParseUint(parameters[0], 0, 64)
+		if err != nil {
+			errcolor.Println("Usage: readat <addr> <length>")
+			return
+		}
+		length, err := strconv.Atoi(parameters[1])
+		if err != nil || length < 0 {
+			errcolor.Println("Usage: readat <addr> <length>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		buf := make([]byte, length)
+		if err := newSharedMemory(c).ReadAt(ctx, addr, buf); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("0x%08x: %q\n", addr, buf)
+	// Write bytes to the shared address space
+	case "writeat":
+		if len(parameters) != 2 {
+			errcolor.Println("Usage: writeat <addr> <text>")
+			return
+		}
+		addr, err := strconv.ParseUint(parameters[0], 0, 64)
+		if err != nil {
+			errcolor.Println("Usage: writeat <addr> <text>")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		defer cancel()
+		if err := newSharedMemory(c).WriteAt(ctx, addr, []byte(parameters[1])); err != nil {
+			errcolor.Println(err)
+			return
+		}
+		syscolor.Printf("%d bytes written at 0x%08x\n", len(parameters[1]), addr)
+	// Display the read hit and miss counters
+	case "stats":
+		stats := c.Stats()
+		syscolor.Printf("Read Hits: %d, Read Misses: %d, Evictions: %d\n", stats.ReadHits, stats.ReadMisses, stats.Evictions)
+		if c.mode == DYNAMIC {
+			syscolor.Printf("Fault Hops: %d, Faults Forwarded for others: %d\n", stats.FaultHops, stats.Forwards)
+		}
+	// Display or set the request retry policy
+	case "retry":
+		if len(parameters) == 0 {
+			syscolor.Printf("Retry Policy: %+v\n", c.retryPolicy())
+			return
+		}
+		if len(parameters) != 3 {
+			errcolor.Println("Usage: retry <maxRetries> <backoffMs> <attemptTimeoutMs>")
+			return
+		}
+		maxRetries, err1 := strconv.Atoi(parameters[0])
+		backoffMs, err2 := strconv.Atoi(parameters[1])
+		timeoutMs, err3 := strconv.Atoi(parameters[2])
+		if err1 != nil || err2 != nil || err3 != nil || maxRetries < 0 || backoffMs < 0 || timeoutMs <= 0 {
+			errcolor.Println("Usage: retry <maxRetries> <backoffMs> <attemptTimeoutMs>")
+			return
+		}
+		policy := c.retryPolicy()
+		policy.MaxRetries = maxRetries
+		policy.Backoff = time.Duration(backoffMs) * time.Millisecond
+		policy.AttemptTimeout = time.Duration(timeoutMs) * time.Millisecond
+		policy.MaxBackoff = max(policy.MaxBackoff, policy.Backoff)
+		c.SetRetryPolicy(policy)
+		syscolor.Printf("Retry Policy: %+v\n", policy)
 	default:
 		syscolor.Println("Wrong Choice")
 	}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrAddressRange is returned for an access that runs past the end of the address space
+var ErrAddressRange = errors.New("access runs past the end of the address space")
+
+// SharedMemory is a flat address space laid over the pages of the cluster. The page at address
+// addr is named by its base address, e.g. 0x00001000 for the second page, and holds PageSize
+// bytes; a page that has never been written reads as zeros.
+type SharedMemory struct {
+	client *Client
+}
+
+// newSharedMemory returns the address space as seen by a Client
+func newSharedMemory(c *Client) *SharedMemory {
+	return &SharedMemory{client: c}
+}
+
+// pageName returns the name of the page holding an address
+func pageName(addr uint64) string {
+	return fmt.Sprintf("0x%08x", addr-addr%PageSize)
+}
+
+// span is the part of an access that falls on one page
+type span struct {
+	pageNo string
+	offset int // offset of the access in the page
+	start  int // offset of the span in the caller's buffer
+	end    int
+}
+
+// spans splits an access of length bytes at addr into one span per page it touches
+func spans(addr uint64, length int) ([]span, error) {
+	if addr+uint64(length) < addr {
+		return nil, ErrAddressRange
+	}
+	var split []span
+	for start := 0; start < length; {
+		at := addr + uint64(start)
+		offset := int(at % PageSize)
+		end := min(length, start+PageSize-offset)
+		split = append(split, span{pageNo: pageName(at), offset: offset, start: start, end: end})
+		start = end
+	}
+	return split, nil
+}
+
+// ReadAt fills buf with the bytes starting at addr. Each page the read touches is faulted in
+// with its own READ_REQUEST unless the Client holds a valid copy.
+func (m *SharedMemory) ReadAt(ctx context.Context, addr uint64, buf []byte) error {
+	split, err := spans(addr, len(buf))
+	if err != nil {
+		return err
+	}
+	for _, s := range split {
+		content, err := m.client.Read(ctx, s.pageNo)
+		if errors.Is(err, ErrPageNotFound) {
+			clear(buf[s.start:s.end])
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		copy(buf[s.start:s.end], content[s.offset:])
+	}
+	return nil
+}
+
+// WriteAt writes buf at addr. Each page the write touches is written with its own WRITE_REQUEST,
+// so a write that straddles pages is not atomic and the pages before a failed one keep the write.
+func (m *SharedMemory) WriteAt(ctx context.Context, addr uint64, buf []byte) error {
+	split, err := spans(addr, len(buf))
+	if err != nil {
+		return err
+	}
+	for _, s := range split {
+		err := m.client.Update(ctx, s.pageNo, func(content []byte) {
+			copy(content[s.offset:], buf[s.start:s.end])
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPagesAreFixedSize(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	if err := clients[0].Write(ctx, "P1", []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := clients[1].Read(ctx, "P1")
+	if err != nil || len(content) != PageSize || text(content) != "ab" {
+		t.Fatalf("read %d bytes %q, %v, want \"ab\" padded to %d bytes", len(content), text(content), err, PageSize)
+	}
+	if err := clients[1].Write(ctx, "P1", make([]byte, PageSize+1)); !errors.Is(err, ErrPageOverflow) {
+		t.Fatalf("got %v, want ErrPageOverflow", err)
+	}
+	// The caller's slice isn't the Client's copy
+	content[0] = 'z'
+	if again, _ := clients[1].Read(ctx, "P1"); again[0] != 'a' {
+		t.Fatal("changing the returned content changed the page")
+	}
+}
+
+func TestSharedMemorySpansPages(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	m1, m2 := newSharedMemory(clients[0]), newSharedMemory(clients[1])
+	data := make([]byte, 2*PageSize+10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := m1.WriteAt(ctx, PageSize-5, data); err != nil {
+		t.Fatal(err)
+	}
+	// Bytes nobody wrote read as zeros, even on pages that don't exist
+	buf := bytes.Repeat([]byte{0xff}, len(data)+PageSize)
+	if err := m2.ReadAt(ctx, 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[PageSize-5:PageSize-5+len(data)], data) {
+		t.Fatal("read back different bytes")
+	}
+	if buf[0] != 0 || buf[len(buf)-1] != 0 {
+		t.Fatal("unwritten bytes aren't zero")
+	}
+	if err := m2.WriteAt(ctx, 2*PageSize-2, []byte("XYZW")); err != nil {
+		t.Fatal(err)
+	}
+	word := make([]byte, 4)
+	if err := m1.ReadAt(ctx, 2*PageSize-2, word); err != nil || string(word) != "XYZW" {
+		t.Fatalf("read %q, %v, want \"XYZW\"", word, err)
+	}
+	if err := m1.ReadAt(ctx, ^uint64(0)-1, word); !errors.Is(err, ErrAddressRange) {
+		t.Fatalf("got %v, want ErrAddressRange", err)
+	}
+}
@@ -14,6 +14,37 @@ const (
 	PULSE                   = "PULSE"
 	CHANGE_CM               = "CHANGE_CM"
 	RECOVERED               = "RECOVERED"
+	PAGE_FAULT              = "PAGE_FAULT"
+	PAGE_UPDATE             = "PAGE_UPDATE"
+	LOCK_ACQUIRE            = "LOCK_ACQUIRE"
+	LOCK_RELEASE            = "LOCK_RELEASE"
+	LOCK_GRANT              = "LOCK_GRANT"
+	BARRIER_ARRIVE          = "BARRIER_ARRIVE"
+	BARRIER_RELEASE         = "BARRIER_RELEASE"
+	DIFF                    = "DIFF"
+	DIFF_FORWARD            = "DIFF_FORWARD"
+	PAGE_EVICT              = "PAGE_EVICT"
+	PAGE_RETURN             = "PAGE_RETURN"
+	ALLOC_PAGE              = "ALLOC_PAGE"
+	FREE_PAGE               = "FREE_PAGE"
+)
+
+// Reasons sent back in Reply.Err when a Central Manager cannot serve a request
+const (
+	PAGE_NOT_FOUND      = "PAGE_NOT_FOUND"
+	OWNER_UNREACHABLE   = "OWNER_UNREACHABLE"
+	INVALIDATION_FAILED = "INVALIDATION_FAILED"
+	NOT_CONFIRMED       = "NOT_CONFIRMED"
+	WRONG_MANAGER       = "WRONG_MANAGER"
+	LOCK_QUEUED         = "LOCK_QUEUED"
+	NOT_LOCK_HOLDER     = "NOT_LOCK_HOLDER"
+	BARRIER_WAITING     = "BARRIER_WAITING"
+	BARRIER_MISMATCH    = "BARRIER_MISMATCH"
+	MULTIPLE_WRITER     = "MULTIPLE_WRITER"
+	NOT_MULTIPLE_WRITER = "NOT_MULTIPLE_WRITER"
+	NOT_OWNER           = "NOT_OWNER"
+	PAGE_FREED          = "PAGE_FREED"
+	FREE_UNSUPPORTED    = "FREE_UNSUPPORTED"
 )
 
 type Payload struct {
@@ -29,18 +60,34 @@ type Payload struct {
 	Pulse        Pulse
 	ChangeCM     ChangeCM
 	Recovered    Recovered
+	Fault        Fault
+	PgUpdate     PgUpdate
+	Lock         Lock
+	Barrier      Barrier
+	Diff         Diff
+	Evict        Evict
+	Alloc        Alloc
 }
 
+// Message is identified by (SenderID, Seq). A retried request keeps its Seq so the
+// Central Manager can recognise it; messages that aren't requests leave Seq at 0.
 type Message struct {
 	Type     string
 	Payload  Payload
 	SenderID int
 	SenderIP string
+	Seq      uint64
 }
 
 type Reply struct {
-	Ack     bool
-	Payload map[string]PgInfo
+	Ack       bool
+	Err       string
+	Duplicate bool
+	Payload   map[string]PgInfo
+	Dedup     map[string]Outcome
+	Locks     map[string]LockState
+	Barriers  map[string]BarrierState
+	Page      Page // an evicted page handed back to the Central Manager, or the ID of an allocated page
 }
 
 type ReadReq struct {
@@ -56,6 +103,7 @@ type ReadForward struct {
 type PgSend struct {
 	Purpose string
 	Page    Page
+	Hops    int // how many times the fault was forwarded before reaching the owner
 }
 
 type ReadConfirm struct {
@@ -64,16 +112,19 @@ type ReadConfirm struct {
 	ReadReqIP string
 	SenderID  int
 	SenderIP  string
+	Version   int
 }
 
 type WriteReq struct {
-	PgNo    string
-	Content string
+	PgNo   string
+	Policy string // coherence policy of the page if the write creates it, the cluster's CoherencePolicy if empty
 }
 
 type InvCopy struct {
 	WriteReqID int
 	PgNum      string
+	NewOwner   ClientPointer // set by an owner invalidating its copies in DYNAMIC mode
+	Freed      bool          // set when the page has been freed, the owner drops it
 }
 
 type InvConfirm struct {
@@ -85,13 +136,15 @@ type WriteForward struct {
 	WriteReqID int
 	WriteReqIP string
 	PgNum      string
-	Content    string
+	CopySet    []ClientPointer // copies the writer has to update if the page's policy is UPDATE
 }
 
 type WriteConfirm struct {
 	WriterID int
 	WriterIP string
 	PgNum    string
+	Version  int
+	CopySet  []ClientPointer // copies that were updated if the page's policy is UPDATE
 }
 
 type Pulse struct {
@@ -100,8 +153,53 @@ type Pulse struct {
 
 type ChangeCM struct {
 	NewCMIP string
+	Shard   int
 }
 
 type Recovered struct {
 	CentralManagerIP string
 }
+
+// Fault is a request for a page that is forwarded along probable owners until it reaches the owner
+type Fault struct {
+	PgNo    string
+	Purpose string
+	ReqID   int
+	ReqIP   string
+	Hops    int
+}
+
+// PgUpdate carries the new content of a page to the holders of its copies
+type PgUpdate struct {
+	Page Page
+}
+
+// Lock names a lock taken with LOCK_ACQUIRE and given back with LOCK_RELEASE
+type Lock struct {
+	Name string
+}
+
+// Barrier is an arrival at round Round of a barrier for N Clients, or the release of that round
+type Barrier struct {
+	Name  string
+	N     int
+	Round int
+}
+
+// Diff is the encoded change a write made to the content of a MULTIPLE page
+type Diff struct {
+	PgNo string
+	Runs []DiffRun
+}
+
+// Evict names a page a Client evicts, a READ copy or a page it owns
+type Evict struct {
+	PgNo  string
+	Owned bool
+}
+
+// Alloc is the policy of a page asked for with ALLOC_PAGE, or the page given back with FREE_PAGE
+type Alloc struct {
+	PgNo   string
+	Policy string // coherence policy of the new page, the cluster's CoherencePolicy if empty
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pageQueue hands out turns on each page in the order the requests arrived.
+// Only the request at the head of a page's queue may run; requests on
+// different pages never wait on each other.
+type pageQueue struct {
+	mu    sync.Mutex
+	pages map[string][]*turn
+}
+
+// turn is one request's place in a page's queue
+type turn struct {
+	requester int
+	ready     chan struct{}
+	done      chan struct{}
+	once      sync.Once
+}
+
+func newPageQueue() *pageQueue {
+	return &pageQueue{pages: map[string][]*turn{}}
+}
+
+// enter queues a request by requester on pgNo and blocks until it is at the head
+func (q *pageQueue) enter(pgNo string, requester int) *turn {
+	t := &turn{
+		requester: requester,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	q.mu.Lock()
+	q.pages[pgNo] = append(q.pages[pgNo], t)
+	if len(q.pages[pgNo]) == 1 {
+		close(t.ready)
+	}
+	q.mu.Unlock()
+	<-t.ready
+	return t
+}
+
+// running reports whether the request at the head of pgNo's queue belongs to requester
+func (q *pageQueue) running(pgNo string, requester int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	turns := q.pages[pgNo]
+	return len(turns) > 0 && turns[0].requester == requester
+}
+
+// enterWithin is enter with a limit on how long to wait. If the request doesn't reach the head
+// in time it leaves the queue and enterWithin reports false.
+func (q *pageQueue) enterWithin(pgNo string, requester int, timeout time.Duration) (*turn, bool) {
+	t := &turn{
+		requester: requester,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	q.mu.Lock()
+	q.pages[pgNo] = append(q.pages[pgNo], t)
+	if len(q.pages[pgNo]) == 1 {
+		close(t.ready)
+	}
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.ready:
+		return t, true
+	case <-timer.C:
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-t.ready:
+		// The turn came just as the wait ran out
+		return t, true
+	default:
+	}
+	turns := q.pages[pgNo]
+	for i, queued := range turns {
+		if queued == t {
+			q.pages[pgNo] = append(turns[:i], turns[i+1:]...)
+			break
+		}
+	}
+	return nil, false
+}
+
+// complete marks the running request on pgNo as finished if it belongs to requester.
+// It reports whether a matching request was found.
+func (q *pageQueue) complete(pgNo string, requester int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	turns := q.pages[pgNo]
+	if len(turns) == 0 || turns[0].requester != requester {
+		return false
+	}
+	turns[0].finish()
+	return true
+}
+
+// leave removes t from the head of pgNo's queue and wakes the next request
+func (q *pageQueue) leave(pgNo string, t *turn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	turns := q.pages[pgNo]
+	if len(turns) == 0 || turns[0] != t {
+		return
+	}
+	turns = turns[1:]
+	if len(turns) == 0 {
+		delete(q.pages, pgNo)
+		return
+	}
+	q.pages[pgNo] = turns
+	close(turns[0].ready)
+}
+
+// finish closes the turn's done channel once
+func (t *turn) finish() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// wait blocks until the turn is completed or the timeout expires.
+// It reports whether the turn was completed.
+func (t *turn) wait(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
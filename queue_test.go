@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// queued waits until n requests are queued on pgNo
+func queued(t *testing.T, q *pageQueue, pgNo string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		length := len(q.pages[pgNo])
+		q.mu.Unlock()
+		if length == n {
+			return
+		}
+	}
+	t.Fatalf("%d requests never queued on %s", n, pgNo)
+}
+
+func TestPageQueueRunsRequestsInArrivalOrder(t *testing.T) {
+	q := newPageQueue()
+	head := q.enter("P1", 1)
+	order := make(chan int, 3)
+	for requester := 2; requester <= 3; requester++ {
+		go func() {
+			turn := q.enter("P1", requester)
+			order <- requester
+			q.leave("P1", turn)
+		}()
+		queued(t, q, "P1", requester)
+	}
+	select {
+	case requester := <-order:
+		t.Fatalf("request of %d ran while the head was running", requester)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.leave("P1", head)
+	for _, want := range []int{2, 3} {
+		if got := <-order; got != want {
+			t.Fatalf("request of %d ran, want %d", got, want)
+		}
+	}
+}
+
+func TestPageQueueKeepsPagesApart(t *testing.T) {
+	q := newPageQueue()
+	q.enter("P1", 1)
+	entered := make(chan struct{})
+	go func() {
+		q.enter("P2", 2)
+		close(entered)
+	}()
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("a request on P2 waited for P1")
+	}
+}
+
+func TestPageQueueCompletesOnlyTheRunningRequest(t *testing.T) {
+	q := newPageQueue()
+	turn := q.enter("P1", 1)
+	if q.running("P1", 2) || q.complete("P1", 2) {
+		t.Fatal("another requester's request counted as running")
+	}
+	if !q.running("P1", 1) || !q.complete("P1", 1) {
+		t.Fatal("the running request could not be completed")
+	}
+	if !turn.wait(time.Second) {
+		t.Fatal("turn not completed")
+	}
+	q.leave("P1", turn)
+	if q.running("P1", 1) {
+		t.Fatal("a request that left still counted as running")
+	}
+}
+
+func TestPageQueueEnterWithinGivesUp(t *testing.T) {
+	q := newPageQueue()
+	head := q.enter("P1", 1)
+	if _, ok := q.enterWithin("P1", 2, 20*time.Millisecond); ok {
+		t.Fatal("entered a busy page")
+	}
+	queued(t, q, "P1", 1)
+	q.leave("P1", head)
+	if _, ok := q.enterWithin("P1", 2, 20*time.Millisecond); !ok {
+		t.Fatal("could not enter a free page")
+	}
+}
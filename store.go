@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With PageStore set every Client keeps the pages it owns on disk, one file per page in a
+// directory named after its ID, so that their content outlives a crash of the Client. A page
+// is written when the Client takes its ownership and after every write the Client makes to it,
+// and removed once the ownership moves on or the page is evicted or freed. Buffered writes
+// are only kept once they are written back. A Client restarted with the same ID and IP reloads
+// the pages it owned, and the Central Manager, which still lists it as their owner, forwards
+// READ_FORWARD and WRITE_FORWARD for them to it as before. Copies the Client doesn't own are not kept.
+// The files aren't synced to disk, so the pages outlive a crash of the Client but not of its machine.
+// A page file holds the page as JSON, with its PageSize bytes of content base64 encoded so that
+// any byte survives.
+
+// pageStore is the directory a Client keeps its owned pages in
+type pageStore struct {
+	dir   string
+	saved map[string]bool // pages that have a file
+}
+
+// storeDir returns the directory of a Client's page store
+func storeDir(id int) string {
+	return fmt.Sprintf("client_%d_pages", id)
+}
+
+// openPageStore opens the page store of a Client and returns the pages kept in it.
+// A new Client starts with an empty store.
+func openPageStore(id int, restore bool) (*pageStore, map[string]Page, error) {
+	s := &pageStore{dir: storeDir(id), saved: map[string]bool{}}
+	if !restore {
+		if err := os.RemoveAll(s.dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	pages, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, pages, nil
+}
+
+// load reads every page kept in the store
+func (s *pageStore) load() (map[string]Page, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := map[string]Page{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			// A temporary file left by a crash while a page was written
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var page Page
+		if err := json.Unmarshal(content, &page); err != nil {
+			return nil, fmt.Errorf("page file %s: %w", entry.Name(), err)
+		}
+		if len(page.Content) != PageSize {
+			return nil, fmt.Errorf("page file %s: content is %d bytes, not %d", entry.Name(), len(page.Content), PageSize)
+		}
+		pages[page.PageId] = page
+		s.saved[page.PageId] = true
+	}
+	return pages, nil
+}
+
+// path returns the file of a page. Page IDs are hex encoded, as they may hold any character.
+func (s *pageStore) path(pageNo string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(pageNo))+".json")
+}
+
+// save writes a page to its file. It is written to a temporary file first, so a crash leaves
+// either the old or the new content. The file isn't synced, as pages are saved while the Client's
+// lock is held.
+func (s *pageStore) save(page Page) error {
+	content, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(page.PageId) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path(page.PageId)); err != nil {
+		return err
+	}
+	s.saved[page.PageId] = true
+	return nil
+}
+
+// remove deletes the file of a page, if it has one
+func (s *pageStore) remove(pageNo string) error {
+	if !s.saved[pageNo] {
+		return nil
+	}
+	if err := os.Remove(s.path(pageNo)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(s.saved, pageNo)
+	return nil
+}
+
+// usePageStore has the Client keep the pages it owns on disk. A restarted Client reloads
+// the pages it owned first.
+func (c *Client) usePageStore(restore bool) error {
+	store, pages, err := openPageStore(c.ID, restore)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store = store
+	for pageNo, page := range pages {
+		c.PgCopySet[pageNo] = page
+		c.touchLocked(pageNo)
+	}
+	if len(pages) > 0 {
+		syscolor.Printf("Client %d reloaded %d owned pages from %s\n", c.ID, len(pages), store.dir)
+	}
+	return nil
+}
+
+// putLocked stores a page in the Page Copy Set, and keeps it on disk while the Client owns it.
+// The caller must hold the Client's lock.
+func (c *Client) putLocked(page Page) {
+	c.PgCopySet[page.PageId] = page
+	if c.store == nil || page.Dirty {
+		return
+	}
+	var err error
+	if page.Owned {
+		err = c.store.save(page)
+	} else {
+		err = c.store.remove(page.PageId)
+	}
+	if err != nil {
+		errcolor.Printf("Client %d could not keep Page %s on disk: %v\n", c.ID, page.PageId, err)
+	}
+}
+
+// deleteLocked drops a page from the Page Copy Set and from disk.
+// The caller must hold the Client's lock.
+func (c *Client) deleteLocked(pageNo string) {
+	delete(c.PgCopySet, pageNo)
+	delete(c.lastUse, pageNo)
+	if c.store == nil {
+		return
+	}
+	if err := c.store.remove(pageNo); err != nil {
+		errcolor.Printf("Client %d could not remove Page %s from disk: %v\n", c.ID, pageNo, err)
+	}
+}
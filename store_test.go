@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+)
+
+// binaryPage returns an owned page whose content isn't valid text
+func binaryPage(pageNo string) Page {
+	page := newPage(pageNo, INVALIDATE)
+	copy(page.Content, "\x80\xff\x00\xfe")
+	page.Owned = true
+	page.Access = READWRITE
+	return page
+}
+
+func TestPageStoreKeepsEveryByte(t *testing.T) {
+	inTempDir(t)
+	s, _, err := openPageStore(7, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := binaryPage("P1")
+	if err := s.save(page); err != nil {
+		t.Fatal(err)
+	}
+	_, pages, err := openPageStore(7, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pages["P1"].Content, page.Content) {
+		t.Fatalf("reloaded %q, want %q", pages["P1"].Content[:4], page.Content[:4])
+	}
+	// A Client that isn't restarted starts with an empty store
+	if _, pages, err := openPageStore(7, false); err != nil || len(pages) != 0 {
+		t.Fatalf("new store holds %d pages, %v", len(pages), err)
+	}
+}
+
+func TestPageFileOfTheWrongSizeIsRejected(t *testing.T) {
+	inTempDir(t)
+	s, _, err := openPageStore(7, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := binaryPage("P1")
+	page.Content = page.Content[:4]
+	content, _ := json.Marshal(page)
+	if err := os.WriteFile(s.path("P1"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openPageStore(7, true); err == nil {
+		t.Fatal("short page file loaded")
+	}
+}
+
+func TestRestartedClientServesThePagesItOwned(t *testing.T) {
+	cm, clients := startCluster(t, CENTRALIZED, 1)
+	ctx := context.Background()
+	l, ip := listen(t)
+	owner := newClient(2, ip, []string{cm.IP})
+	owner.mode = CENTRALIZED
+	if err := owner.usePageStore(false); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, l, CLIENT, owner)
+	page := binaryPage("P1")
+	if err := owner.Write(ctx, "P1", page.Content); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Write(ctx, "P2", []byte("moves")); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[0].Write(ctx, "P2", []byte("moved")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// The restarted Client has the same ID and IP, so the Central Manager still finds it
+	l, err := net.Listen("tcp", ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	restarted := newClient(2, ip, []string{cm.IP})
+	restarted.mode = CENTRALIZED
+	if err := restarted.usePageStore(true); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, l, CLIENT, restarted)
+	if _, kept := restarted.page("P2"); kept {
+		t.Fatal("page owned by another Client reloaded")
+	}
+	content, err := clients[0].Read(ctx, "P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, page.Content) {
+		t.Fatalf("read %q, want %q", content[:4], page.Content[:4])
+	}
+}
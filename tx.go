@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+)
+
+var (
+	ErrTxConflict = errors.New("page changed since the transaction read it")
+	ErrTxDone     = errors.New("transaction already committed or aborted")
+)
+
+// Tx is a transaction of a Client. Its writes are kept in the transaction until Commit,
+// which makes all of them or none.
+type Tx struct {
+	client *Client
+	reads  map[string]int    // version of every page read by the transaction
+	writes map[string][]byte // content written by the transaction, PageSize bytes
+	done   bool
+}
+
+// A transaction commits by taking every page it read or wrote with an ordinary WRITE_REQUEST, in
+// page order so that two transactions can't each hold a page the other is waiting for. A page
+// that arrives is pinned before the write is confirmed: the Client holds back READ_FORWARDs,
+// WRITE_FORWARDs and faults for it until the commit ends, so the page can't move on while
+// the other pages are taken. Once every page is held, the pages the transaction read are checked
+// against the versions it read and all writes are made at once. If a page can't be taken, because
+// its Central Manager or a holder of a copy fails, the pinned pages are let go without any of the
+// writes. MULTIPLE pages can't be taken, so a transaction that uses one fails to commit.
+
+// BeginTx starts a transaction
+func (c *Client) BeginTx() *Tx {
+	return &Tx{client: c, reads: map[string]int{}, writes: map[string][]byte{}}
+}
+
+// Read returns the content of a page as the transaction sees it
+func (tx *Tx) Read(ctx context.Context, pageNo string) ([]byte, error) {
+	if tx.done {
+		return nil, &PageError{Op: "read", PgNo: pageNo, Err: ErrTxDone}
+	}
+	if content, written := tx.writes[pageNo]; written {
+		return bytes.Clone(content), nil
+	}
+	page, err := tx.client.read(ctx, pageNo)
+	if err != nil {
+		return nil, err
+	}
+	if _, read := tx.reads[pageNo]; !read {
+		tx.reads[pageNo] = page.Version
+	}
+	return bytes.Clone(page.Content), nil
+}
+
+// Write sets the content of a page, padded with zeros to PageSize bytes, when the transaction commits
+func (tx *Tx) Write(pageNo string, content []byte) error {
+	if tx.done {
+		return &PageError{Op: "write", PgNo: pageNo, Err: ErrTxDone}
+	}
+	page, err := fit(content)
+	if err != nil {
+		return &PageError{Op: "write", PgNo: pageNo, Err: err}
+	}
+	tx.writes[pageNo] = page
+	return nil
+}
+
+// Abort drops the transaction's writes
+func (tx *Tx) Abort() {
+	tx.done = true
+}
+
+// Commit makes every write of the transaction, or none of them if it returns an error.
+// A page that was read fails the commit with ErrTxConflict if it was written by somebody
+// else in between, whether or not the transaction writes it. A Client commits one transaction at a time.
+func (tx *Tx) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	c := tx.client
+	c.commits.Lock()
+	defer c.commits.Unlock()
+
+	pages := slices.Collect(maps.Keys(tx.reads))
+	for pageNo := range tx.writes {
+		if _, read := tx.reads[pageNo]; !read {
+			pages = append(pages, pageNo)
+		}
+	}
+	slices.Sort(pages)
+	defer c.unpin(pages)
+	for _, pageNo := range pages {
+		if err := c.pin(ctx, pageNo); err != nil {
+			errcolor.Printf("Transaction of Client %d aborted at Page %s\n", c.ID, pageNo)
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	for _, pageNo := range pages {
+		version, read := tx.reads[pageNo]
+		if !c.PgCopySet[pageNo].Owned || (read && c.PgCopySet[pageNo].Version != version) {
+			c.mu.Unlock()
+			errcolor.Printf("Transaction of Client %d aborted, Page %s was written since it was read\n", c.ID, pageNo)
+			return &PageError{Op: "commit", PgNo: pageNo, Err: ErrTxConflict}
+		}
+	}
+	var updated []Page
+	for _, pageNo := range slices.Sorted(maps.Keys(tx.writes)) {
+		page := c.PgCopySet[pageNo]
+		page.Content = tx.writes[pageNo]
+		page.Version++
+		page.Dirty = false
+		page.Twin = nil
+		c.putLocked(page)
+		if page.Policy == UPDATE && len(page.CopySet) > 0 {
+			updated = append(updated, page)
+		}
+	}
+	c.mu.Unlock()
+
+	// The copies of UPDATE pages get the new content while the pages are still pinned
+	for _, page := range updated {
+		c.pushUpdates(page)
+	}
+	syscolor.Printf("Transaction of Client %d committed %d pages\n", c.ID, len(tx.writes))
+	return nil
+}
+
+// pin takes a page with READWRITE access, faulting it in for WRITE if needed, and pins it
+func (c *Client) pin(ctx context.Context, pageNo string) error {
+	c.mu.Lock()
+	page, exists := c.PgCopySet[pageNo]
+	if exists && page.Access == READWRITE {
+		c.pinLocked(pageNo)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	// The page is pinned when it arrives, before its ownership is confirmed
+	pin := func(page Page) Page {
+		c.pinLocked(pageNo)
+		return page
+	}
+	_, err := c.fault(ctx, "commit", pageNo, WRITE, pin, c.requester(pageNo, WRITE, ""))
+	return err
+}
+
+// pinLocked pins a page. The caller must hold the Client's lock.
+func (c *Client) pinLocked(pageNo string) {
+	if _, pinned := c.pinned[pageNo]; !pinned {
+		c.pinned[pageNo] = make(chan struct{})
+	}
+}
+
+// unpin lets go of pinned pages and the requests held back for them
+func (c *Client) unpin(pages []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pageNo := range pages {
+		if unpinned, pinned := c.pinned[pageNo]; pinned {
+			close(unpinned)
+			delete(c.pinned, pageNo)
+		}
+	}
+}
+
+// lockUnpinned takes the Client's lock once a page isn't pinned, holding back a request
+// for the page until the commit that pinned it ends
+func (c *Client) lockUnpinned(pageNo string) {
+	c.mu.Lock()
+	for {
+		unpinned, pinned := c.pinned[pageNo]
+		if !pinned {
+			return
+		}
+		c.mu.Unlock()
+		syscolor.Printf("Page %s is pinned by a transaction, holding the request back\n", pageNo)
+		<-unpinned
+		c.mu.Lock()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// transfer moves one from page A to page B in a transaction, trying again after conflicts
+func transfer(ctx context.Context, c *Client) error {
+	for {
+		tx := c.BeginTx()
+		a, err := tx.Read(ctx, "A")
+		if err != nil {
+			return err
+		}
+		b, err := tx.Read(ctx, "B")
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(text(a))
+		m, _ := strconv.Atoi(text(b))
+		tx.Write("A", []byte(strconv.Itoa(n-1)))
+		tx.Write("B", []byte(strconv.Itoa(m+1)))
+		err = tx.Commit(ctx)
+		if !errors.Is(err, ErrTxConflict) {
+			return err
+		}
+	}
+}
+
+func TestTransactionsKeepTheTotal(t *testing.T) {
+	for _, mode := range []string{CENTRALIZED, IMPROVED, DYNAMIC} {
+		t.Run(mode, func(t *testing.T) {
+			_, clients := startCluster(t, mode, 3)
+			ctx := context.Background()
+			for _, pageNo := range []string{"A", "B"} {
+				if err := clients[0].Write(ctx, pageNo, []byte("100")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var wg sync.WaitGroup
+			for _, c := range clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 8 {
+						if err := transfer(ctx, c); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			a, errA := clients[1].Read(ctx, "A")
+			b, errB := clients[2].Read(ctx, "B")
+			if errA != nil || errB != nil || text(a) != "76" || text(b) != "124" {
+				t.Fatalf("A is %q (%v) and B is %q (%v), want 76 and 124", text(a), errA, text(b), errB)
+			}
+		})
+	}
+}
+
+func TestCommitFailsIfAPageOnlyReadChanged(t *testing.T) {
+	_, clients := startCluster(t, CENTRALIZED, 2)
+	ctx := context.Background()
+	c, other := clients[0], clients[1]
+	if err := other.Write(ctx, "IDX", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	tx := c.BeginTx()
+	if _, err := tx.Read(ctx, "IDX"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("D", []byte("data"))
+	if err := other.Write(ctx, "IDX", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("got %v, want ErrTxConflict", err)
+	}
+	if content, _ := other.Read(ctx, "D"); text(content) != "" {
+		t.Fatalf("D is %q after the conflict, want it unwritten", text(content))
+	}
+	if err := tx.Commit(ctx); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("got %v, want ErrTxDone", err)
+	}
+
+	tx = c.BeginTx()
+	if _, err := tx.Read(ctx, "IDX"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Write("D", []byte("data"))
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := other.Read(ctx, "D"); err != nil || text(content) != "data" {
+		t.Fatalf("read %q, %v, want \"data\"", text(content), err)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"time"
 )
 
 const (
@@ -14,14 +16,27 @@ const (
 	CENTRALMANAGER = "CentralManager"
 )
 
+// DIAL_TIMEOUT bounds how long a node waits to connect to another node
+const DIAL_TIMEOUT = 2 * time.Second
+
+// dialRPC connects to the node at targetIP
+func dialRPC(targetIP string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", targetIP, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
 func (cm *CentralManager) CallRPC(msg Message, nodeType string, targetID int, targetIP string) (reply Reply) {
 	sendcolor.Printf("Central Manager with is sending Msg '%s' to Client%d\n", removeUnderscores(msg.Type), targetID)
-	clnt, err := rpc.Dial("tcp", targetIP)
+	clnt, err := dialRPC(targetIP)
 	if err != nil {
 		errcolor.Println("Error dialing RPC: ", err)
 		reply.Ack = false
 		return reply
 	}
+	defer clnt.Close()
 	err = clnt.Call(fmt.Sprintf("%s.HandleIncMsg", nodeType), msg, &reply)
 	if err != nil {
 		errcolor.Printf("Error calling RPC from Msg '%s': %v\n", removeUnderscores(msg.Type), err)
@@ -34,12 +49,13 @@ func (cm *CentralManager) CallRPC(msg Message, nodeType string, targetID int, ta
 // CallRPC is a method for Client struct that sends a message to a target node
 func (client *Client) CallRPC(msg Message, nodeType string, targetID int, targetIP string) (reply Reply) {
 	sendcolor.Printf("Client%d is sending Msg '%s' to %s%d\n", client.ID, removeUnderscores(msg.Type), nodeType, targetID)
-	clnt, err := rpc.Dial("tcp", targetIP)
+	clnt, err := dialRPC(targetIP)
 	if err != nil {
 		errcolor.Println("Error dialing RPC: ", err)
 		reply.Ack = false
 		return reply
 	}
+	defer clnt.Close()
 	err = clnt.Call(fmt.Sprintf("%s.HandleIncMsg", nodeType), msg, &reply)
 	if err != nil {
 		errcolor.Printf("Error calling RPC from Msg '%s': %v\n", removeUnderscores(msg.Type), err)
@@ -101,7 +117,15 @@ func clientwrite(clients []Client) error {
 	return nil
 }
 
-func primaryCMIP() (string, error) {
+// shardOf returns the shard whose Central Manager is responsible for a page
+func shardOf(pgNo string) int {
+	h := fnv.New32a()
+	h.Write([]byte(pgNo))
+	return int(h.Sum32() % uint32(Managers))
+}
+
+// primaryCMIP returns the IP of the primary Central Manager of a shard
+func primaryCMIP(shard int) (string, error) {
 	fileContent, err := os.ReadFile(CMPATH)
 	if err != nil {
 		errcolor.Println("Error reading centralmanager.json: ", err)
@@ -112,15 +136,30 @@ func primaryCMIP() (string, error) {
 		errcolor.Println("Error Unmarshalling []Central Manager: ", err)
 	}
 	for _, cm := range cms {
-		if cm.IsPrimary {
+		if cm.IsPrimary && cm.Shard == shard {
 			return cm.IP, nil
 		}
 	}
+	err = fmt.Errorf("no primary Central Manager for shard %d", shard)
 	errcolor.Println("Primary Central Manager not found: ", err)
 	return "NIL", err
 }
 
-func backCMIP() (string, error) {
+// primaryCMIPs returns the IP of the primary Central Manager of every shard, indexed by shard
+func primaryCMIPs() ([]string, error) {
+	ips := make([]string, Managers)
+	for shard := range ips {
+		ip, err := primaryCMIP(shard)
+		if err != nil {
+			return nil, err
+		}
+		ips[shard] = ip
+	}
+	return ips, nil
+}
+
+// backCMIP returns the IP of the backup Central Manager of a shard
+func backCMIP(shard int) (string, error) {
 	fileContent, err := os.ReadFile(CMPATH)
 	if err != nil {
 		errcolor.Println("Error reading cm.json: ", err)
@@ -131,14 +170,35 @@ func backCMIP() (string, error) {
 		errcolor.Println("Error Unmarshalling []Central Manager: ", err)
 	}
 	for _, cm := range cms {
-		if !cm.IsPrimary {
+		if !cm.IsPrimary && cm.Shard == shard {
 			return cm.IP, nil
 		}
 	}
-	errcolor.Println("Primary Central Manager not found: ", err)
+	err = fmt.Errorf("no backup Central Manager for shard %d", shard)
+	errcolor.Println("Backup Central Manager not found: ", err)
 	return "NIL", err
 }
 
+// vacantCMRole returns the role a new Central Manager takes: the primary of the first shard
+// without one, otherwise the backup of the first shard without one
+func vacantCMRole(cms []CentralManager) (shard int, isPrimary bool, ok bool) {
+	for _, primary := range []bool{true, false} {
+		for shard := 0; shard < Managers; shard++ {
+			taken := false
+			for _, cm := range cms {
+				if cm.Shard == shard && cm.IsPrimary == primary {
+					taken = true
+					break
+				}
+			}
+			if !taken {
+				return shard, primary, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
 // maxClientID returns the maximum client ID in the list of clients
 func maxClientID(clients []Client) int {
 	if len(clients) == 0 {
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// SNAPSHOT_EVERY is how many metadata changes are logged before the log is compacted into a snapshot
+const SNAPSHOT_EVERY = 100
+
+// A Central Manager keeps its metadata on disk so that it survives losing both Central Managers
+// of a shard. Every change to a page's information is appended to a write-ahead log and synced
+// before the Central Manager goes on; once the log holds SNAPSHOT_EVERY changes the whole metadata
+// is written to a snapshot and the log starts over. Changes are queued while the Central Manager's
+// lock is held and written after it is let go, so requests for other pages don't wait for the disk
+// and one sync covers every change queued in the meantime. A restarting Central Manager rebuilds its
+// metadata from the snapshot and the changes logged after it before it accepts requests, and then
+// takes the metadata of a live Central Manager of its shard if there is one. A change cut short by
+// a crash is ignored. Only the metadata is kept, not the locks, barriers or the dedup table.
+// A backup logs the pages that changed each time it takes the metadata of the primary.
+
+// walEntry is a change to the information of a page
+type walEntry struct {
+	PgNo    string
+	Info    PgInfo
+	Deleted bool
+}
+
+// metaLog is the write-ahead log and snapshot of a Central Manager's metadata
+type metaLog struct {
+	walPath      string
+	snapshotPath string
+
+	mu      *sync.Mutex // guards the queue
+	pending []walWrite  // queued writes not taken by a sync yet
+	queued  int         // writes queued so far
+	entries int         // changes queued since the last snapshot
+
+	io     *sync.Mutex // held while writing and syncing, guards file and synced
+	file   *os.File
+	synced int // writes on disk so far
+}
+
+// walWrite is a queued change to the log, or a snapshot of the metadata after the changes before it
+type walWrite struct {
+	line     []byte
+	snapshot []byte
+}
+
+// diskName returns the name of a Central Manager's files, made from its IP
+func diskName(ip string) string {
+	return "cm_" + strings.NewReplacer(":", "_", ".", "_").Replace(ip)
+}
+
+// openMetaLog opens the log of the Central Manager with the given IP and returns the metadata
+// kept in it. A new Central Manager starts with an empty log.
+func openMetaLog(ip string, restore bool) (*metaLog, map[string]PgInfo, error) {
+	l := &metaLog{
+		walPath:      diskName(ip) + ".wal",
+		snapshotPath: diskName(ip) + ".snapshot",
+		mu:           &sync.Mutex{},
+		io:           &sync.Mutex{},
+	}
+	metaData := map[string]PgInfo{}
+	if restore {
+		var err error
+		if metaData, err = l.load(); err != nil {
+			return nil, nil, err
+		}
+	}
+	file, err := os.OpenFile(l.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.file = file
+	// Starting from a snapshot of what was rebuilt also drops a change cut short by a crash
+	content, err := json.Marshal(metaData)
+	if err == nil {
+		err = l.snapshot(content)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return l, metaData, nil
+}
+
+// load rebuilds the metadata from the snapshot and the changes logged after it
+func (l *metaLog) load() (map[string]PgInfo, error) {
+	metaData := map[string]PgInfo{}
+	content, err := os.ReadFile(l.snapshotPath)
+	if err == nil {
+		if err := json.Unmarshal(content, &metaData); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", l.snapshotPath, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.Open(l.walPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return metaData, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	replayed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			warningcolor.Printf("Ignoring a change to the metadata cut short in %s\n", l.walPath)
+			break
+		}
+		if entry.Deleted {
+			delete(metaData, entry.PgNo)
+		} else {
+			metaData[entry.PgNo] = entry.Info
+		}
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	syscolor.Printf("Rebuilt the metadata of %d pages from %s and %d logged changes\n", len(metaData), l.snapshotPath, replayed)
+	return metaData, nil
+}
+
+// queue queues a change for the next sync. Once SNAPSHOT_EVERY changes have been queued,
+// metaData, which already holds the change, is queued as a snapshot as well.
+func (l *metaLog) queue(entry walEntry, metaData map[string]PgInfo) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(l.pending, walWrite{line: append(line, '\n')})
+	l.queued++
+	l.entries++
+	if l.entries < SNAPSHOT_EVERY {
+		return nil
+	}
+	content, err := json.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+	l.pending = append(l.pending, walWrite{snapshot: content})
+	l.queued++
+	l.entries = 0
+	return nil
+}
+
+// sync writes the writes queued so far to disk and syncs them. A sync that finds them written by
+// another sync returns straight away; otherwise it takes every queued write, so that the writes
+// queued while the previous sync ran are synced together.
+func (l *metaLog) sync() error {
+	l.mu.Lock()
+	target := l.queued
+	l.mu.Unlock()
+
+	l.io.Lock()
+	defer l.io.Unlock()
+	if l.synced >= target {
+		return nil
+	}
+	l.mu.Lock()
+	writes := l.pending
+	l.pending = nil
+	l.synced = l.queued
+	l.mu.Unlock()
+
+	var lines []byte
+	for _, write := range writes {
+		if write.snapshot == nil {
+			lines = append(lines, write.line...)
+			continue
+		}
+		// The log is emptied by the snapshot, so the changes before it only have to be written
+		if err := l.append(lines, false); err != nil {
+			return err
+		}
+		lines = nil
+		if err := l.snapshot(write.snapshot); err != nil {
+			return err
+		}
+	}
+	return l.append(lines, true)
+}
+
+// append writes lines to the log, and syncs the log if asked to
+func (l *metaLog) append(lines []byte, sync bool) error {
+	if len(lines) > 0 {
+		if _, err := l.file.Write(lines); err != nil {
+			return err
+		}
+	}
+	if !sync {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// snapshot writes the encoded metadata to the snapshot and empties the log. The snapshot is
+// written to a temporary file first, so a crash leaves either the old or the new snapshot.
+func (l *metaLog) snapshot(content []byte) error {
+	tmp := l.snapshotPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.snapshotPath); err != nil {
+		return err
+	}
+	return l.file.Truncate(0)
+}
+
+// persist has the Central Manager keep its metadata on disk. A restarting Central Manager
+// rebuilds its metadata from disk first.
+func (cm *CentralManager) persist(restore bool) error {
+	wal, metaData, err := openMetaLog(cm.IP, restore)
+	if err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.wal = wal
+	cm.MetaData = metaData
+	return nil
+}
+
+// logLocked queues a change to the information of a page for the log. The caller must hold the
+// Central Manager's lock, have made the change already and call syncLog once it has let go of the lock.
+func (cm *CentralManager) logLocked(pgNo string, info PgInfo, deleted bool) {
+	if cm.wal == nil {
+		return
+	}
+	entry := walEntry{PgNo: pgNo, Info: info, Deleted: deleted}
+	if err := cm.wal.queue(entry, cm.MetaData); err != nil {
+		errcolor.Printf("Could not log the change to Page %s: %v\n", pgNo, err)
+	}
+}
+
+// syncLog writes the changes logged so far to disk, so that they are kept before the Central
+// Manager goes on. The caller must not hold the Central Manager's lock.
+func (cm *CentralManager) syncLog() {
+	cm.mu.Lock()
+	wal := cm.wal
+	cm.mu.Unlock()
+	if wal == nil {
+		return
+	}
+	if err := wal.sync(); err != nil {
+		errcolor.Printf("Could not write the changes to the metadata of shard %d to disk: %v\n", cm.Shard, err)
+	}
+}
+
+// logChangesLocked logs the pages whose information differs from previous, e.g. after taking
+// the metadata from another Central Manager, so that an unchanged metadata costs nothing.
+// The caller must hold the Central Manager's lock and have replaced the metadata already.
+func (cm *CentralManager) logChangesLocked(previous map[string]PgInfo) {
+	if cm.wal == nil {
+		return
+	}
+	for _, pgNo := range slices.Sorted(maps.Keys(cm.MetaData)) {
+		info := cm.MetaData[pgNo]
+		if old, exists := previous[pgNo]; !exists || !reflect.DeepEqual(old, info) {
+			cm.logLocked(pgNo, info, false)
+		}
+	}
+	for _, pgNo := range slices.Sorted(maps.Keys(previous)) {
+		if _, exists := cm.MetaData[pgNo]; !exists {
+			cm.logLocked(pgNo, previous[pgNo], true)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// restarted returns a Central Manager rebuilt from the files cm keeps its metadata in
+func restarted(t *testing.T, cm *CentralManager) *CentralManager {
+	t.Helper()
+	again := newCentralManager(cm.IP, cm.Shard, true)
+	if err := again.persist(true); err != nil {
+		t.Fatal(err)
+	}
+	return again
+}
+
+// persisted returns a Central Manager that keeps its metadata on disk, with no metadata yet
+func persisted(t *testing.T) *CentralManager {
+	t.Helper()
+	inTempDir(t)
+	cm := newCentralManager("127.0.0.1:1", 0, true)
+	if err := cm.persist(false); err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func TestMetaDataSurvivesARestart(t *testing.T) {
+	cm := persisted(t)
+	home := newPage("H", INVALIDATE)
+	copy(home.Content, "\x80\xff\x00\xfe")
+	cm.setPageInfo("P1", PgInfo{Owner: ClientPointer{ID: 1, IP: "127.0.0.1:2"}, CopySet: []ClientPointer{{ID: 2}}, Version: 4})
+	cm.setPageInfo("H", PgInfo{Home: &home, Version: 3})
+	cm.setPageInfo("GONE", PgInfo{Version: 1})
+	cm.deletePageInfo("GONE")
+
+	metaData := restarted(t, cm).metaDataCopy()
+	if info := metaData["P1"]; info.Owner.ID != 1 || len(info.CopySet) != 1 || info.Version != 4 {
+		t.Fatalf("P1 rebuilt as %+v", info)
+	}
+	if info := metaData["H"]; info.Home == nil || !bytes.Equal(info.Home.Content, home.Content) {
+		t.Fatal("home copy not rebuilt byte for byte")
+	}
+	if _, exists := metaData["GONE"]; exists {
+		t.Fatal("deleted page rebuilt")
+	}
+}
+
+func TestChangeCutShortIsIgnored(t *testing.T) {
+	cm := persisted(t)
+	cm.setPageInfo("P1", PgInfo{Version: 1})
+	file, err := os.OpenFile(cm.wal.walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"PgNo":"P2","Info":{"Vers`)
+	file.Close()
+
+	metaData := restarted(t, cm).metaDataCopy()
+	if _, exists := metaData["P2"]; exists || metaData["P1"].Version != 1 {
+		t.Fatalf("rebuilt %+v, want only P1", metaData)
+	}
+}
+
+func TestLogIsCompactedIntoASnapshot(t *testing.T) {
+	cm := persisted(t)
+	for i := range SNAPSHOT_EVERY + 5 {
+		cm.setPageInfo(fmt.Sprint("P", i), PgInfo{Version: i})
+	}
+	if cm.wal.entries != 5 {
+		t.Fatalf("%d changes logged since the snapshot, want 5", cm.wal.entries)
+	}
+	if metaData := restarted(t, cm).metaDataCopy(); len(metaData) != SNAPSHOT_EVERY+5 {
+		t.Fatalf("rebuilt %d pages, want %d", len(metaData), SNAPSHOT_EVERY+5)
+	}
+}
+
+func TestTakingMetaDataLogsOnlyChanges(t *testing.T) {
+	cm := persisted(t)
+	home := newPage("H", INVALIDATE)
+	copy(home.Content, "\x80\xff\x00\xfe")
+	cm.setPageInfo("H", PgInfo{Home: &home, Version: 3})
+	cm.setPageInfo("P1", PgInfo{Version: 1})
+	logged := cm.wal.entries
+	// What a backup takes from every PULSE is mostly what it already has
+	for range 5 {
+		cm.setMetaData(cm.metaDataCopy())
+	}
+	if cm.wal.entries != logged {
+		t.Fatalf("%d changes logged for unchanged metadata", cm.wal.entries-logged)
+	}
+	next := cm.metaDataCopy()
+	delete(next, "P1")
+	next["P2"] = PgInfo{Version: 2}
+	cm.setMetaData(next)
+	if cm.wal.entries != logged+2 {
+		t.Fatalf("%d changes logged, want the deletion and the new page", cm.wal.entries-logged)
+	}
+
+	metaData := restarted(t, cm).metaDataCopy()
+	if _, exists := metaData["P1"]; exists || metaData["P2"].Version != 2 {
+		t.Fatalf("rebuilt %+v, want P1 deleted and P2 added", metaData)
+	}
+	if info := metaData["H"]; info.Home == nil || !bytes.Equal(info.Home.Content, home.Content) {
+		t.Fatal("home copy not rebuilt byte for byte")
+	}
+}
+
+func TestSyncDoesntHoldTheCentralManager(t *testing.T) {
+	cm := persisted(t)
+	// A slow disk: the log can't be written until the test lets go of it
+	cm.wal.io.Lock()
+	done := make(chan struct{})
+	go func() {
+		cm.setPageInfo("P1", PgInfo{Version: 1})
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if info, _ := cm.pageInfo("P1"); info.Version == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the Central Manager was held while its log was written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("the change went on before it was synced")
+	default:
+	}
+	cm.wal.io.Unlock()
+	<-done
+	if metaData := restarted(t, cm).metaDataCopy(); metaData["P1"].Version != 1 {
+		t.Fatalf("rebuilt %+v, want P1", metaData)
+	}
+}
+
+func TestConcurrentChangesAreAllLogged(t *testing.T) {
+	cm := persisted(t)
+	pages := SNAPSHOT_EVERY + 50
+	var wg sync.WaitGroup
+	for i := range pages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cm.setPageInfo(fmt.Sprint("P", i), PgInfo{Version: i})
+		}()
+	}
+	wg.Wait()
+	metaData := restarted(t, cm).metaDataCopy()
+	if len(metaData) != pages {
+		t.Fatalf("rebuilt %d pages, want %d", len(metaData), pages)
+	}
+	for i := range pages {
+		if info := metaData[fmt.Sprint("P", i)]; info.Version != i {
+			t.Fatalf("P%d rebuilt at version %d", i, info.Version)
+		}
+	}
+}